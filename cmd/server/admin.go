@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"github.com/turtlearmy/online-whiteboard/internal/room"
+	"github.com/turtlearmy/online-whiteboard/internal/store"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+// Adds the admin API, which needs the admin token as a bearer token
+func registerAdmin(r *gin.Engine) {
+	admin := r.Group("/admin", requireAdmin)
+	admin.GET("/rooms", getAdminRooms)
+	admin.GET("/rooms/:room", getAdminRoom)
+	admin.POST("/rooms/:room/close", postAdminClose)
+	admin.DELETE("/rooms/:room", deleteAdminRoom)
+	admin.GET("/rooms/:room/snapshot", getAdminSnapshot)
+	admin.PUT("/rooms/:room/snapshot", putAdminSnapshot)
+	admin.DELETE("/rooms/:room/connections/:conn", deleteAdminConnection)
+	admin.PUT("/rooms/:room/layers/:layer/owner", putAdminLayerOwner)
+	admin.POST("/rooms/:room/notice", postAdminNotice)
+}
+
+func requireAdmin(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Admin.Token)) != 1 {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+	}
+}
+
+// Responds with the status matching err's code
+func adminError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch errcode.CodeOf(err) {
+	case errcode.NotFound:
+		status = http.StatusNotFound
+	case errcode.InvalidArgument, errcode.InvalidPacket:
+		status = http.StatusBadRequest
+	}
+	if errors.Is(err, room.ErrClosed) {
+		// The room was unloaded while being used
+		status = http.StatusNotFound
+	}
+	if errors.Is(err, room.ErrTooManyRooms) {
+		status = http.StatusServiceUnavailable
+	}
+	if status == http.StatusInternalServerError {
+		slog.Error("error in admin request", "path", c.Request.URL.Path, "err", err)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+// Rooms that aren't loaded are restored from the store, like other requests
+// for them
+func adminRoom(c *gin.Context) *room.Room {
+	r, err := rooms.LookupRoom(c.Param("room"))
+	if err != nil {
+		adminError(c, err)
+	} else if r == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "room not found"})
+	}
+	return r
+}
+
+// Lists every loaded and stored room, including private ones
+func getAdminRooms(c *gin.Context) {
+	list, err := rooms.Summaries()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func getAdminRoom(c *gin.Context) {
+	r := adminRoom(c)
+	if r == nil {
+		return
+	}
+	details, err := r.Details()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, details)
+}
+
+func postAdminClose(c *gin.Context) {
+	if err := rooms.CloseRoom(c.Param("room")); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteAdminRoom(c *gin.Context) {
+	if err := rooms.DeleteRoom(c.Param("room")); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func getAdminSnapshot(c *gin.Context) {
+	r := adminRoom(c)
+	if r == nil {
+		return
+	}
+	snapshot, err := r.Snapshot()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// Creates or replaces the room with a snapshot
+func putAdminSnapshot(c *gin.Context) {
+	var snapshot store.Room
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		adminError(c, errcode.Wrap(errcode.InvalidArgument, err))
+		return
+	}
+	if err := rooms.RestoreRoom(c.Param("room"), &snapshot); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteAdminConnection(c *gin.Context) {
+	conn, err := strconv.ParseUint(c.Param("conn"), 10, 0)
+	if err != nil {
+		adminError(c, errcode.Wrap(errcode.InvalidArgument, err))
+		return
+	}
+	r := adminRoom(c)
+	if r == nil {
+		return
+	}
+	if err := r.Kick(uint(conn)); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func putAdminLayerOwner(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("layer"), 10, 0)
+	if err != nil {
+		adminError(c, errcode.Wrap(errcode.InvalidArgument, err))
+		return
+	}
+	var body struct {
+		Owner user.Id `json:"owner"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		adminError(c, errcode.Wrap(errcode.InvalidArgument, err))
+		return
+	}
+	r := adminRoom(c)
+	if r == nil {
+		return
+	}
+	if err := r.SetLayerOwner(layer.Id(id), body.Owner); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func postAdminNotice(c *gin.Context) {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		adminError(c, errcode.Wrap(errcode.InvalidArgument, err))
+		return
+	}
+	r := adminRoom(c)
+	if r == nil {
+		return
+	}
+	if err := r.Notice(body.Message); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -1,53 +1,383 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/turtlearmy/online-whiteboard/internal/config"
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+	"github.com/turtlearmy/online-whiteboard/internal/ora"
+	"github.com/turtlearmy/online-whiteboard/internal/ratelimit"
 	"github.com/turtlearmy/online-whiteboard/internal/room"
+	"github.com/turtlearmy/online-whiteboard/internal/store"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
+	"github.com/turtlearmy/online-whiteboard/web"
 )
 
-// Gets the session cookie for the request, setting it if necessary
+const sessionCookie = "session"
+
+var cfg config.Config
+var rooms *room.RoomRegistry
+var signer *user.Signer
+
+// Set once the server starts stopping
+var shuttingDown atomic.Bool
+
+// How long health checks wait for a room to respond
+const healthTimeout = 5 * time.Second
+
+// Gets the session of the request, setting the session cookie if it's missing
+// or wasn't signed by this server
 func getSession(c *gin.Context) user.Session {
-	session, err := c.Cookie("session")
+	if session, ok := c.Get(sessionCookie); ok {
+		return session.(user.Session)
+	}
+	value, err := c.Cookie(sessionCookie)
+	session, ok := signer.Verify(value)
+	if err != nil || !ok {
+		session = user.NewSession()
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    signer.Sign(session),
+			Path:     "/",
+			MaxAge:   int(cfg.Session.Lifetime.Seconds()),
+			Secure:   cfg.SecureCookies(),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	c.Set(sessionCookie, session)
+	return session
+}
+
+// Sends plain HTTP requests to the same path on the HTTPS server
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(cfg.Listen); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+func serve(server *http.Server, tls bool) {
+	var err error
+	if tls {
+		err = server.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("error running server", err)
+	}
+}
+
+// Replaces the default logger, which the log package also writes to
+func setupLogging() {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.LogFormat == config.LogJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// Logs each request once it's been handled, instead of gin's own request log
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	slog.Info("request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"client", c.ClientIP())
+}
+
+// Fails if the room checked by this request doesn't handle a task in time
+func getHealthz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthTimeout)
+	defer cancel()
+	if err := rooms.Ping(ctx); err != nil {
+		slog.Error("health check failed", "err", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Fails once the server starts stopping or if rooms can't be saved
+func getReadyz(c *gin.Context) {
+	err := rooms.Ready()
+	if err == nil && shuttingDown.Load() {
+		err = errors.New("shutting down")
+	}
 	if err != nil {
-		session = string(user.NewSession())
-		c.SetCookie("session", session, 24*24*60, "", "", false, false)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+		return
 	}
-	return user.Session(session)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func getIndex(c *gin.Context) {
-	roomName := c.Request.URL.Query().Get("room_name")
+	query := c.Request.URL.Query()
+	roomName := query.Get("room_name")
 	if room.ValidName(roomName) {
-		public := c.Request.URL.Query().Get("public") == "on"
-		room.GetRoom(roomName, public) // Create room
+		settings := rooms.DefaultSettings()
+		settings.Public = query.Get("public") == "on"
+		if width, err := strconv.Atoi(query.Get("width")); err == nil {
+			settings.Width = width
+		}
+		if height, err := strconv.Atoi(query.Get("height")); err == nil {
+			settings.Height = height
+		}
+		if policy := user.Policy(query.Get("backpressure")); policy != "" {
+			if !policy.Valid() {
+				c.String(http.StatusBadRequest, "unknown backpressure policy '%s'", policy)
+				return
+			}
+			settings.Backpressure.Policy = policy
+		}
+		if !rooms.Limits().ValidCanvasSize(settings.Width, settings.Height) {
+			c.String(http.StatusBadRequest, "canvas size must be at most %dx%d and at most %d pixels", canvas.MaxWidth, canvas.MaxHeight, rooms.Limits().MaxCanvasArea)
+			return
+		}
+		if _, err := rooms.GetRoom(roomName, settings); err != nil { // Create room
+			roomError(c, roomName, err)
+			return
+		}
 		roomId := room.UrlName(roomName)
 		c.Redirect(http.StatusTemporaryRedirect, "/draw/"+roomId)
 	} else {
-		c.HTML(http.StatusOK, "index.tmpl.html", gin.H{"Rooms": room.PublicRooms()})
+		c.HTML(http.StatusOK, "index.tmpl.html", gin.H{
+			"Rooms":     rooms.PublicRooms(),
+			"MaxWidth":  canvas.MaxWidth,
+			"MaxHeight": canvas.MaxHeight,
+		})
 	}
 }
 
 func getWorkspace(c *gin.Context) {
-	roomId := c.Param("room")
-	roomName := room.GetRoom(roomId, false).Name()
-	c.HTML(http.StatusOK, "workspace.tmpl.html", gin.H{"Name": roomName})
+	roomId := room.UrlName(c.Param("room"))
+	room, err := rooms.GetRoom(c.Param("room"), rooms.DefaultSettings())
+	if err != nil {
+		roomError(c, c.Param("room"), err)
+		return
+	}
+	if room == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.HTML(http.StatusOK, "workspace.tmpl.html", gin.H{"Name": room.Name(), "Id": roomId})
+}
+
+// Exports all layers of a room flattened into a single png
+func getExportPNG(c *gin.Context) {
+	room, err := rooms.LookupRoom(c.Param("room"))
+	if err != nil {
+		roomError(c, c.Param("room"), err)
+		return
+	}
+	if room == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	img, err := room.Flatten()
+	if err != nil {
+		exportError(c, room, err)
+		return
+	}
+	c.Header("Content-Type", "image/png")
+	if err := png.Encode(c.Writer, img); err != nil {
+		slog.Error("error encoding png export", "room", c.Param("room"), "err", err)
+	}
+}
+
+// Exports all layers of a room as an OpenRaster archive
+func getExportORA(c *gin.Context) {
+	room, err := rooms.LookupRoom(c.Param("room"))
+	if err != nil {
+		roomError(c, c.Param("room"), err)
+		return
+	}
+	if room == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	doc, err := room.OpenRaster()
+	if err != nil {
+		exportError(c, room, err)
+		return
+	}
+	c.Header("Content-Type", "image/openraster")
+	if err := doc.Write(c.Writer); err != nil {
+		slog.Error("error writing openraster export", "room", c.Param("room"), "err", err)
+	}
+}
+
+// Responds to a room that couldn't be created or restored
+func roomError(c *gin.Context, name string, err error) {
+	if errors.Is(err, room.ErrTooManyRooms) || errors.Is(err, room.ErrClosed) {
+		c.Header("Retry-After", "10")
+		c.String(http.StatusServiceUnavailable, err.Error())
+		c.Abort()
+		return
+	}
+	slog.Error("error loading room", "room", name, "err", err)
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// Rooms that were unloaded while being exported can be exported again once
+// they're restored
+func exportError(c *gin.Context, r *room.Room, err error) {
+	if errors.Is(err, room.ErrClosed) {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, room.ErrTooLarge) {
+		c.String(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	slog.Error("error exporting room", "room", r.Name(), "err", err)
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// Creates a new room from an uploaded OpenRaster archive
+func postImport(c *gin.Context) {
+	// Leaves room for the other form fields
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, ora.MaxArchiveSize+1<<20)
+	roomName := c.PostForm("room_name")
+	public := c.PostForm("public") == "on"
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.String(http.StatusRequestEntityTooLarge, "archive is larger than %d bytes", ora.MaxArchiveSize)
+			return
+		}
+		c.String(http.StatusBadRequest, "missing file")
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := rooms.ImportRoom(roomName, public, f, header.Size); errors.Is(err, room.ErrTooManyRooms) || errors.Is(err, room.ErrClosed) {
+		roomError(c, roomName, err)
+		return
+	} else if err != nil {
+		c.String(http.StatusBadRequest, "error importing room: %v", err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/draw/"+room.UrlName(roomName))
 }
 
 func main() {
-	r := gin.Default()
+	var printConfig bool
+	var err error
+	cfg, printConfig, err = config.Load(os.Args[1:])
+	if err != nil {
+		fatal("error loading config", err)
+	}
+	if printConfig {
+		data, err := cfg.YAML()
+		if err != nil {
+			fatal("error printing config", err)
+		}
+		fmt.Print(string(data))
+		return
+	}
+	setupLogging()
+
+	key, err := cfg.SessionKey()
+	if err != nil {
+		fatal("error loading session key", err)
+	}
+	signer = user.NewSigner(key)
 
-	r.LoadHTMLFiles(
-		"web/templates/workspace.tmpl.html",
-		"web/templates/index.tmpl.html",
-	)
+	var roomStore store.Store
+	if cfg.Storage.Backend == config.StorageFile {
+		if roomStore, err = store.NewFileStore(cfg.Storage.Dir); err != nil {
+			fatal("error opening room store", err)
+		}
+	}
+	rooms = room.NewRoomRegistry(room.Options{
+		Store:           roomStore,
+		Defaults:        roomSettings(cfg),
+		Limits:          roomLimits(cfg),
+		ReadBufferSize:  cfg.Rooms.ReadBufferSize,
+		WriteBufferSize: cfg.Rooms.WriteBufferSize,
+	})
+
+	if cfg.LogLevel == "debug" {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	r := gin.New()
+	r.Use(logRequests, gin.Recovery())
+
+	files := web.Files(cfg.Web.Dir)
+	templates, err := template.ParseFS(files, "templates/*.tmpl.html")
+	if err != nil {
+		fatal("error loading templates", err)
+	}
+	r.SetHTMLTemplate(templates)
+
+	// Added before the session middleware, since admins and health checks
+	// don't need sessions
+	if cfg.Admin.Token != "" {
+		registerAdmin(r)
+	}
+	r.GET("/healthz", getHealthz)
+	r.GET("/readyz", getReadyz)
+
+	// Set session cookie for all connections. Middleware only applies to
+	// routes added after it
+	r.Use(func(c *gin.Context) { getSession(c) })
 
 	r.GET("/", getIndex)
 	r.GET("/draw/:room", getWorkspace)
+	r.POST("/import", postImport)
+	r.GET("/draw/:room/export.png", getExportPNG)
+	r.GET("/draw/:room/export.ora", getExportORA)
 	r.GET("/draw/:room/ws", func(c *gin.Context) {
-		room := room.GetRoom(c.Param("room"), false)
+		room, err := rooms.GetRoom(c.Param("room"), rooms.DefaultSettings())
+		if err != nil {
+			roomError(c, c.Param("room"), err)
+			return
+		}
 		if room == nil {
 			c.AbortWithStatus(http.StatusNotFound)
 			return
@@ -55,12 +385,81 @@ func main() {
 		room.WsHandler(c.Writer, c.Request, getSession(c))
 	})
 
-	r.StaticFS("/javascript", http.Dir("web/static/javascript"))
-	r.StaticFS("/css", http.Dir("web/static/css"))
-	r.StaticFS("/icons", http.Dir("web/static/icons"))
+	for _, dir := range []string{"javascript", "css", "icons"} {
+		static, err := fs.Sub(files, path.Join("static", dir))
+		if err != nil {
+			fatal("error loading static files", err)
+		}
+		r.StaticFS("/"+dir, http.FS(static))
+	}
 
-	// Set session cookie for all connections
-	r.Use(func(c *gin.Context) { getSession(c) })
+	server := &http.Server{Addr: cfg.Listen, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go serve(server, cfg.TLS.Cert != "")
+	// Servers for plain HTTP alongside the main one
+	var others []*http.Server
+	if cfg.TLS.Redirect != "" {
+		others = append(others, &http.Server{Addr: cfg.TLS.Redirect, Handler: http.HandlerFunc(redirectToHTTPS)})
+	}
+	if cfg.Metrics.Listen != "" {
+		prometheus.MustRegister(rooms)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		others = append(others, &http.Server{Addr: cfg.Metrics.Listen, Handler: mux})
+	}
+	for _, s := range others {
+		go serve(s, false)
+	}
+
+	<-ctx.Done()
+	// A second signal stops the server immediately
+	stop()
+	slog.Info("shutting down")
+	shuttingDown.Store(true)
+	if cfg.Rooms.ShutdownDelay > 0 {
+		time.Sleep(cfg.Rooms.ShutdownDelay)
+	}
 
-	r.Run("0.0.0.0:8080")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Rooms.ShutdownTimeout)
+	defer cancel()
+	// Websockets aren't waited for, since they're closed by their rooms
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("error stopping http server", "addr", server.Addr, "err", err)
+	}
+	for _, s := range others {
+		if err := s.Shutdown(ctx); err != nil {
+			slog.Error("error stopping http server", "addr", s.Addr, "err", err)
+		}
+	}
+	if err := rooms.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down rooms", "err", err)
+	}
+}
+
+// Settings of new rooms that don't choose their own
+func roomSettings(cfg config.Config) room.Settings {
+	settings := room.DefaultSettings()
+	settings.Width = cfg.Canvas.DefaultWidth
+	settings.Height = cfg.Canvas.DefaultHeight
+	settings.Backpressure = cfg.Rooms.Backpressure
+	return settings
+}
+
+func roomLimits(cfg config.Config) room.Limits {
+	limits := room.Limits{
+		MaxMessageSize:     cfg.Rooms.MaxMessageSize,
+		MaxCanvasArea:      cfg.Canvas.MaxArea,
+		MaxLoadedRooms:     cfg.Rooms.MaxLoaded,
+		MaxRoomConnections: cfg.Rooms.MaxConnections,
+		ConnectionPackets:  cfg.RateLimits.ConnectionPackets.Rate(),
+		ConnectionBytes:    cfg.RateLimits.ConnectionBytes.Rate(),
+		UserPackets:        cfg.RateLimits.UserPackets.Rate(),
+		UserBytes:          cfg.RateLimits.UserBytes.Rate(),
+		PacketTypes:        map[string]ratelimit.Rate{},
+	}
+	for t, r := range cfg.RateLimits.PacketTypes {
+		limits.PacketTypes[t] = r.Rate()
+	}
+	return limits
 }
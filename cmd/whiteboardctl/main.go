@@ -0,0 +1,225 @@
+// Command whiteboardctl manages the rooms of a running server through its
+// admin API
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/turtlearmy/online-whiteboard/internal/adminapi"
+)
+
+const usage = `usage: whiteboardctl [flags] <command> [arguments]
+
+commands:
+  rooms                      list loaded and stored rooms, including private ones
+  show <room>                print a room's layers and users as JSON
+  snapshot <room> <file>     save a room to a file, or - for stdout
+  restore <room> <file>      replace a room with a saved snapshot
+  export <room> <file>       export a room as a .png or .ora file
+  kick <room> <user id>      close every connection of a user
+  announce <room> <message>  show a message to everyone in a room
+  close <room>               save and unload a room, closing its connections
+  delete <room>              delete a room, closing its connections
+
+flags:
+`
+
+type command struct {
+	// Number of arguments. The last argument of commands with a negative
+	// number takes the rest of the command line
+	args int
+	run  func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"rooms":    {0, listRooms},
+	"show":     {1, showRoom},
+	"snapshot": {2, saveSnapshot},
+	"restore":  {2, restoreSnapshot},
+	"export":   {2, exportRoom},
+	"kick":     {2, kickUser},
+	"announce": {-2, announce},
+	"close":    {1, closeRoom},
+	"delete":   {1, deleteRoom},
+}
+
+var jsonOutput bool
+
+func main() {
+	fs := flag.NewFlagSet("whiteboardctl", flag.ExitOnError)
+	server := fs.String("server", envOr("WHITEBOARD_SERVER", "http://localhost:8080"), "URL of the server (env WHITEBOARD_SERVER)")
+	// The environment variable isn't the flag's default so usage doesn't
+	// print it
+	token := fs.String("token", "", "the server's admin token (env WHITEBOARD_ADMIN_TOKEN)")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long each request can take, including downloading exports, or 0 for no limit")
+	fs.BoolVar(&jsonOutput, "json", false, "print rooms as JSON")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	args := fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	args = args[1:]
+	if !ok || cmd.args >= 0 && len(args) != cmd.args || cmd.args < 0 && len(args) < -cmd.args {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if cmd.args < 0 {
+		last := -cmd.args - 1
+		args = append(args[:last], strings.Join(args[last:], " "))
+	}
+
+	if *token == "" {
+		*token = os.Getenv("WHITEBOARD_ADMIN_TOKEN")
+	}
+	if err := cmd.run(&client{server: *server, token: *token, http: http.Client{Timeout: *timeout}}, args); err != nil {
+		fmt.Fprintf(os.Stderr, "whiteboardctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func listRooms(c *client, args []string) error {
+	var rooms []adminapi.Summary
+	if err := c.do("GET", "/admin/rooms", nil, &rooms); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(rooms)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tLOADED\tPUBLIC\tCONNECTIONS\tONLINE USERS\tLAYERS")
+	for _, r := range rooms {
+		if !r.Loaded {
+			fmt.Fprintf(w, "%s\tfalse\t-\t-\t-\t-\n", r.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\ttrue\t%t\t%d\t%d\t%d\n", r.Name, r.Public, r.Connections, r.OnlineUsers, r.LayerCount)
+	}
+	return w.Flush()
+}
+
+func showRoom(c *client, args []string) error {
+	var details adminapi.Details
+	if err := c.do("GET", roomPath(args[0]), nil, &details); err != nil {
+		return err
+	}
+	return printJSON(details)
+}
+
+// Opens path for writing, or stdout if it's -. Files are removed if writing
+// them fails
+func writeFile(path string, write func(w io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func saveSnapshot(c *client, args []string) error {
+	return writeFile(args[1], func(w io.Writer) error {
+		return c.download(roomPath(args[0], "/snapshot"), w)
+	})
+}
+
+func restoreSnapshot(c *client, args []string) error {
+	var data []byte
+	var err error
+	if args[1] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[1])
+	}
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("%s isn't a snapshot", args[1])
+	}
+	return c.do("PUT", roomPath(args[0], "/snapshot"), json.RawMessage(data), nil)
+}
+
+// Uses the server's export links, which don't need the admin token
+func exportRoom(c *client, args []string) error {
+	ext := strings.ToLower(filepath.Ext(args[1]))
+	if ext != ".png" && ext != ".ora" {
+		return fmt.Errorf("can only export .png or .ora files, not %q", args[1])
+	}
+	return writeFile(args[1], func(w io.Writer) error {
+		return c.download("/draw/"+url.PathEscape(args[0])+"/export"+ext, w)
+	})
+}
+
+func kickUser(c *client, args []string) error {
+	id, err := strconv.ParseUint(args[1], 10, 0)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q", args[1])
+	}
+	var details adminapi.Details
+	if err := c.do("GET", roomPath(args[0]), nil, &details); err != nil {
+		return err
+	}
+	for _, u := range details.Users {
+		if u.Id != uint(id) {
+			continue
+		}
+		for _, conn := range u.Connections {
+			if err := c.do("DELETE", roomPath(args[0], "/connections/", strconv.FormatUint(uint64(conn), 10)), nil, nil); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("closed %d connections of %s\n", len(u.Connections), u.Name)
+		return nil
+	}
+	return fmt.Errorf("user %d not found in room %s", id, args[0])
+}
+
+func announce(c *client, args []string) error {
+	return c.do("POST", roomPath(args[0], "/notice"), map[string]string{"message": args[1]}, nil)
+}
+
+func closeRoom(c *client, args []string) error {
+	return c.do("POST", roomPath(args[0], "/close"), nil, nil)
+}
+
+func deleteRoom(c *client, args []string) error {
+	return c.do("DELETE", roomPath(args[0]), nil, nil)
+}
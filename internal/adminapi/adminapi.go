@@ -0,0 +1,40 @@
+// Package adminapi has the types of the admin API's responses, which are
+// shared by the server and whiteboardctl
+package adminapi
+
+// Only Name is set for rooms that aren't loaded, which is their key in the
+// store
+type Summary struct {
+	Name        string `json:"name"`
+	Loaded      bool   `json:"loaded"`
+	Public      bool   `json:"public"`
+	Connections int    `json:"connections"`
+	OnlineUsers int    `json:"online_users"`
+	LayerCount  int    `json:"layer_count"`
+}
+
+type Details struct {
+	Summary
+	// Id of the user who owns the room
+	Owner  uint           `json:"owner"`
+	Width  int            `json:"width"`
+	Height int            `json:"height"`
+	Layers []LayerDetails `json:"layers"`
+	Users  []UserDetails  `json:"users"`
+}
+
+type LayerDetails struct {
+	Id    uint   `json:"id"`
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Owner uint   `json:"owner"`
+	// 0 is the top layer
+	Height int `json:"height"`
+}
+
+type UserDetails struct {
+	Id   uint   `json:"id"`
+	Name string `json:"name"`
+	// Ids of the user's open connections
+	Connections []uint `json:"connections"`
+}
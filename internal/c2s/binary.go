@@ -0,0 +1,43 @@
+package c2s
+
+import (
+	"encoding/binary"
+
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+)
+
+// Binary packets start with a byte identifying their type followed by a
+// uint32 request id. The rest is decoded by the packet's decoder
+const BinaryHeaderSize = 5
+
+type binaryDecoder struct {
+	packetType string
+	decode     func(data []byte) (layer.Handler, error)
+}
+
+var binaryRegistry = map[byte]binaryDecoder{}
+
+// packetType is the name of the packet's JSON form
+func RegisterBinary(id byte, packetType string, decode func(data []byte) (layer.Handler, error)) error {
+	binaryRegistry[id] = binaryDecoder{packetType, decode}
+	return nil
+}
+
+func DeserializeBinary(data []byte) (Packet, error) {
+	if len(data) < BinaryHeaderSize {
+		return Packet{}, errcode.New(errcode.InvalidPacket, "binary packet is too short")
+	}
+	packet := Packet{RequestId: RequestId(binary.BigEndian.Uint32(data[1:]))}
+	decoder, ok := binaryRegistry[data[0]]
+	if !ok {
+		return packet, errcode.Errorf(errcode.InvalidPacket, "unknown binary packet type %d", data[0])
+	}
+	packet.Type = decoder.packetType
+	handler, err := decoder.decode(data[BinaryHeaderSize:])
+	if err != nil {
+		return packet, errcode.Wrap(errcode.InvalidPacket, err)
+	}
+	packet.Handler = handler
+	return packet, nil
+}
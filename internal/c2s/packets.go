@@ -2,16 +2,27 @@ package c2s
 
 import (
 	"encoding/json"
-	"fmt"
 
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 )
 
 var registry = map[string]func() layer.Handler{}
 
+// Identifies a request so its result can be reported back to the client. 0
+// means the client didn't set one
+type RequestId uint32
+
+type Packet struct {
+	Type      string
+	RequestId RequestId
+	Handler   layer.Handler
+}
+
 type rawMessage struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data"`
+	Type      string          `json:"type"`
+	RequestId RequestId       `json:"request_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
 }
 
 func Register(packetType string, constructor func() layer.Handler) error {
@@ -19,18 +30,28 @@ func Register(packetType string, constructor func() layer.Handler) error {
 	return nil
 }
 
-func Deserialize(rawData []byte) (layer.Handler, error) {
+// Whether packets of the type can be decoded
+func Registered(packetType string) bool {
+	_, ok := registry[packetType]
+	return ok
+}
+
+// The returned packet has as much of the type and request id as could be
+// decoded, even if decoding failed
+func Deserialize(rawData []byte) (Packet, error) {
 	var msg rawMessage
 	if err := json.Unmarshal(rawData, &msg); err != nil {
-		return nil, err
+		return Packet{}, errcode.Wrap(errcode.InvalidPacket, err)
 	}
-	packetType, ok := registry[msg.Type]
+	packet := Packet{Type: msg.Type, RequestId: msg.RequestId}
+	constructor, ok := registry[msg.Type]
 	if !ok {
-		return nil, fmt.Errorf("unknown packet type '%s'", msg.Type)
+		return packet, errcode.Errorf(errcode.InvalidPacket, "unknown packet type '%s'", msg.Type)
 	}
-	packet := packetType()
-	if err := json.Unmarshal(msg.Data, packet); err != nil {
-		return nil, err
+	handler := constructor()
+	if err := json.Unmarshal(msg.Data, handler); err != nil {
+		return packet, errcode.Wrap(errcode.InvalidPacket, err)
 	}
+	packet.Handler = handler
 	return packet, nil
 }
@@ -0,0 +1,376 @@
+// Package config loads the server's configuration. Command line flags override
+// WHITEBOARD_ environment variables, which override the YAML config file,
+// which overrides the defaults
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+	"gopkg.in/yaml.v2"
+)
+
+// Storage backends
+const (
+	// Saves rooms as files in Storage.Dir
+	StorageFile = "file"
+	// Keeps rooms in memory until they're unloaded
+	StorageMemory = "memory"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// Log formats
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+type Config struct {
+	// Address the server listens on
+	Listen     string     `yaml:"listen"`
+	TLS        TLS        `yaml:"tls"`
+	Web        Web        `yaml:"web"`
+	Session    Session    `yaml:"session"`
+	Canvas     Canvas     `yaml:"canvas"`
+	Rooms      Rooms      `yaml:"rooms"`
+	RateLimits RateLimits `yaml:"rate_limits"`
+	Storage    Storage    `yaml:"storage"`
+	Metrics    Metrics    `yaml:"metrics"`
+	Admin      Admin      `yaml:"admin"`
+	// One of debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+	// LogText or LogJSON
+	LogFormat string `yaml:"log_format"`
+}
+
+// Paths of a certificate and its key. TLS is only used if both are set
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Address to listen on for plain HTTP requests, which are redirected to
+	// HTTPS. Not listened on if empty
+	Redirect string `yaml:"redirect"`
+}
+
+type Web struct {
+	// Directory with templates and static directories to serve the web
+	// client from instead of the files embedded in the server
+	Dir string `yaml:"dir"`
+}
+
+type Session struct {
+	// How long session cookies last
+	Lifetime time.Duration `yaml:"lifetime"`
+	// Key session cookies are signed with. If empty, the key in KeyFile is
+	// used, and generated if the file doesn't exist
+	Secret  string `yaml:"secret"`
+	KeyFile string `yaml:"key_file"`
+	// Marks cookies as HTTPS only without TLS, for servers behind a proxy
+	// that handles TLS. Always on with TLS
+	Secure bool `yaml:"secure"`
+}
+
+type Canvas struct {
+	// Size of new rooms that don't choose their own
+	DefaultWidth  int `yaml:"default_width"`
+	DefaultHeight int `yaml:"default_height"`
+	// Most pixels a room's canvas can have
+	MaxArea int `yaml:"max_area"`
+}
+
+type Rooms struct {
+	// How long to wait for rooms to be saved when stopping
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// How long to keep serving after /readyz starts failing when stopping,
+	// so load balancers stop sending requests first
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+	// Most rooms loaded at once, and most connections to each room. Not
+	// limited if 0
+	MaxLoaded      int `yaml:"max_loaded"`
+	MaxConnections int `yaml:"max_connections"`
+	// Size in bytes of the largest message a connection can send
+	MaxMessageSize int64 `yaml:"max_message_size"`
+	// Sizes in bytes of each websocket's buffers. They don't limit the size of
+	// messages
+	ReadBufferSize  int               `yaml:"read_buffer_size"`
+	WriteBufferSize int               `yaml:"write_buffer_size"`
+	Backpressure    user.Backpressure `yaml:"backpressure"`
+}
+
+type RateLimits struct {
+	ConnectionPackets Rate `yaml:"connection_packets"`
+	ConnectionBytes   Rate `yaml:"connection_bytes"`
+	UserPackets       Rate `yaml:"user_packets"`
+	UserBytes         Rate `yaml:"user_bytes"`
+	// Packets of each type received on each connection
+	PacketTypes map[string]Rate `yaml:"packet_types"`
+}
+
+type Storage struct {
+	// StorageFile or StorageMemory
+	Backend string `yaml:"backend"`
+	// Directory rooms are saved in by the file backend
+	Dir string `yaml:"dir"`
+}
+
+type Metrics struct {
+	// Address /metrics is served on. Kept separate from Listen by default,
+	// since metrics name private rooms. Not served if empty
+	Listen string `yaml:"listen"`
+}
+
+type Admin struct {
+	// Bearer token of the admin API under /admin. The API is off if empty
+	Token string `yaml:"token"`
+}
+
+func Default() Config {
+	return Config{
+		Listen: "0.0.0.0:8080",
+		Session: Session{
+			Lifetime: 30 * 24 * time.Hour,
+			KeyFile:  "data/session.key",
+		},
+		Canvas: Canvas{canvas.DefaultWidth, canvas.DefaultHeight, 4096 * 4096},
+		Rooms: Rooms{
+			ShutdownTimeout: 10 * time.Second,
+			MaxLoaded:       1000,
+			MaxConnections:  100,
+			MaxMessageSize:  32 << 20,
+			ReadBufferSize:  1 << 16,
+			WriteBufferSize: 1 << 16,
+			Backpressure:    user.DefaultBackpressure(),
+		},
+		RateLimits: RateLimits{
+			ConnectionPackets: Rate{PerSecond: 200, Burst: 400},
+			ConnectionBytes:   Rate{PerSecond: 8 << 20, Burst: 64 << 20},
+			UserPackets:       Rate{PerSecond: 300, Burst: 600},
+			UserBytes:         Rate{PerSecond: 16 << 20, Burst: 128 << 20},
+			// Keyed by the types packets are registered with by c2s.Register
+			PacketTypes: map[string]Rate{
+				"paint_layer_set":  {PerSecond: 2, Burst: 10},
+				"c2s_create_layer": {PerSecond: 2, Burst: 10},
+				"resize_room":      {PerSecond: 1, Burst: 5},
+				"resync_layer":     {PerSecond: 5, Burst: 20},
+				"set_username":     {PerSecond: 1, Burst: 5},
+			},
+		},
+		Storage:   Storage{StorageFile, "data/rooms"},
+		Metrics:   Metrics{"127.0.0.1:9464"},
+		LogLevel:  "info",
+		LogFormat: LogText,
+	}
+}
+
+// Loads the configuration from the command line arguments, environment and
+// the config file named by the -config flag or WHITEBOARD_CONFIG. Returns
+// whether -print-config was set
+func Load(args []string) (cfg Config, printConfig bool, err error) {
+	cfg = Default()
+	path := configPath(args)
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return Config{}, false, err
+		}
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.String("config", path, "path of a YAML config file (env WHITEBOARD_CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the configuration and exit")
+	cfg.register(fs)
+
+	// Environment variables override the file, and flags override both
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return Config{}, false, envErr
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+	return cfg, printConfig, cfg.Validate()
+}
+
+func (cfg *Config) register(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address to listen on")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "path of the TLS certificate")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "path of the TLS certificate's key")
+	fs.StringVar(&cfg.TLS.Redirect, "tls-redirect", cfg.TLS.Redirect, "address to listen on for plain HTTP requests to redirect to HTTPS, e.g. :80")
+	fs.StringVar(&cfg.Web.Dir, "web-dir", cfg.Web.Dir, "directory to serve the web client from instead of the embedded files, e.g. web")
+	fs.DurationVar(&cfg.Session.Lifetime, "session-lifetime", cfg.Session.Lifetime, "how long session cookies last")
+	fs.StringVar(&cfg.Session.Secret, "session-secret", cfg.Session.Secret, "key session cookies are signed with")
+	fs.StringVar(&cfg.Session.KeyFile, "session-key-file", cfg.Session.KeyFile, "file the session key is generated in if no secret is set")
+	fs.BoolVar(&cfg.Session.Secure, "secure-cookies", cfg.Session.Secure, "only send cookies over HTTPS even without TLS, e.g. behind a TLS proxy")
+	fs.IntVar(&cfg.Canvas.DefaultWidth, "canvas-width", cfg.Canvas.DefaultWidth, "default canvas width of new rooms")
+	fs.IntVar(&cfg.Canvas.DefaultHeight, "canvas-height", cfg.Canvas.DefaultHeight, "default canvas height of new rooms")
+	fs.IntVar(&cfg.Canvas.MaxArea, "canvas-max-area", cfg.Canvas.MaxArea, "most pixels a room's canvas can have")
+	fs.DurationVar(&cfg.Rooms.ShutdownTimeout, "shutdown-timeout", cfg.Rooms.ShutdownTimeout, "how long to wait for rooms to be saved when stopping")
+	fs.DurationVar(&cfg.Rooms.ShutdownDelay, "shutdown-delay", cfg.Rooms.ShutdownDelay, "how long to keep serving after /readyz starts failing when stopping")
+	fs.IntVar(&cfg.Rooms.MaxLoaded, "max-rooms", cfg.Rooms.MaxLoaded, "most rooms loaded at once, or 0 for no limit")
+	fs.IntVar(&cfg.Rooms.MaxConnections, "max-room-connections", cfg.Rooms.MaxConnections, "most connections to each room, or 0 for no limit")
+	fs.Int64Var(&cfg.Rooms.MaxMessageSize, "max-message-size", cfg.Rooms.MaxMessageSize, "size in bytes of the largest message a connection can send")
+	fs.IntVar(&cfg.Rooms.ReadBufferSize, "read-buffer-size", cfg.Rooms.ReadBufferSize, "size in bytes of each websocket's read buffer")
+	fs.IntVar(&cfg.Rooms.WriteBufferSize, "write-buffer-size", cfg.Rooms.WriteBufferSize, "size in bytes of each websocket's write buffer")
+	fs.Var((*policyValue)(&cfg.Rooms.Backpressure.Policy), "backpressure", "default policy for slow connections: drop_and_resync, coalesce_draws or disconnect")
+	fs.IntVar(&cfg.Rooms.Backpressure.MaxMessages, "backpressure-max-messages", cfg.Rooms.Backpressure.MaxMessages, "broadcasts queued for a connection before it's slow")
+	fs.IntVar(&cfg.Rooms.Backpressure.MaxBytes, "backpressure-max-bytes", cfg.Rooms.Backpressure.MaxBytes, "bytes queued for a connection before it's slow")
+	fs.Var(&cfg.RateLimits.ConnectionPackets, "rate-connection-packets", "packets per second/burst for each connection")
+	fs.Var(&cfg.RateLimits.ConnectionBytes, "rate-connection-bytes", "bytes per second/burst for each connection")
+	fs.Var(&cfg.RateLimits.UserPackets, "rate-user-packets", "packets per second/burst for each user")
+	fs.Var(&cfg.RateLimits.UserBytes, "rate-user-bytes", "bytes per second/burst for each user")
+	fs.StringVar(&cfg.Storage.Backend, "storage", cfg.Storage.Backend, "where rooms are saved: file or memory")
+	fs.StringVar(&cfg.Storage.Dir, "storage-dir", cfg.Storage.Dir, "directory rooms are saved in by the file storage")
+	fs.StringVar(&cfg.Metrics.Listen, "metrics-listen", cfg.Metrics.Listen, "address to serve Prometheus metrics on, or empty to disable them")
+	fs.StringVar(&cfg.Admin.Token, "admin-token", cfg.Admin.Token, "bearer token of the admin API, which is off if empty")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "text or json")
+}
+
+// The config file is read before the other flags are parsed, since they
+// override it
+func configPath(args []string) string {
+	path := os.Getenv("WHITEBOARD_CONFIG")
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if value := strings.TrimPrefix(name, "config="); value != name {
+			path = value
+		} else if name == "config" && i+1 < len(args) {
+			path = args[i+1]
+		}
+	}
+	return path
+}
+
+func envName(flagName string) string {
+	return "WHITEBOARD_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Settings missing from the file keep their defaults, including the limits of
+// each packet type
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	packetTypes := cfg.RateLimits.PacketTypes
+	cfg.RateLimits.PacketTypes = map[string]Rate{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+	for t, r := range packetTypes {
+		if _, ok := cfg.RateLimits.PacketTypes[t]; !ok {
+			cfg.RateLimits.PacketTypes[t] = r
+		}
+	}
+	return nil
+}
+
+// Replaces secrets when printing the configuration
+const redacted = "REDACTED"
+
+// The configuration with its secrets redacted
+func (cfg Config) YAML() ([]byte, error) {
+	if cfg.Session.Secret != "" {
+		cfg.Session.Secret = redacted
+	}
+	if cfg.Admin.Token != "" {
+		cfg.Admin.Token = redacted
+	}
+	return yaml.Marshal(cfg)
+}
+
+// Returns every problem with the configuration
+func (cfg Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.Listen != "", "listen address must be set")
+	check((cfg.TLS.Cert == "") == (cfg.TLS.Key == ""), "TLS certificate and key must both be set or both be empty")
+	check(cfg.Web.Dir == "" || isDir(filepath.Join(cfg.Web.Dir, "templates")) && isDir(filepath.Join(cfg.Web.Dir, "static")),
+		"web directory %q must have templates and static directories", cfg.Web.Dir)
+	check(cfg.TLS.Redirect == "" || cfg.TLS.Cert != "", "TLS redirect requires a TLS certificate")
+	check(cfg.Session.Lifetime > 0, "session lifetime must be positive")
+	check(cfg.Session.Secret != "" || cfg.Session.KeyFile != "", "session secret or key file must be set")
+	check(cfg.Session.Secret == "" || len(cfg.Session.Secret) >= 16, "session secret must be at least 16 characters")
+	check(canvas.ValidSize(cfg.Canvas.DefaultWidth, cfg.Canvas.DefaultHeight), "default canvas size must be at most %dx%d", canvas.MaxWidth, canvas.MaxHeight)
+	check(cfg.Canvas.DefaultWidth*cfg.Canvas.DefaultHeight <= cfg.Canvas.MaxArea, "default canvas size must be at most the max canvas area")
+	check(cfg.Rooms.ShutdownTimeout > 0, "shutdown timeout must be positive")
+	check(cfg.Rooms.ShutdownDelay >= 0, "shutdown delay can't be negative")
+	check(cfg.Rooms.MaxLoaded >= 0 && cfg.Rooms.MaxConnections >= 0, "room limits can't be negative")
+	check(cfg.Rooms.MaxMessageSize > 0, "max message size must be positive")
+	check(cfg.Rooms.ReadBufferSize > 0 && cfg.Rooms.WriteBufferSize > 0, "buffer sizes must be positive")
+	backpressureErr := cfg.Rooms.Backpressure.Validate()
+	check(backpressureErr == nil, "%v", backpressureErr)
+	check(cfg.RateLimits.ConnectionBytes.Unlimited() || int64(cfg.RateLimits.ConnectionBytes.Burst) >= cfg.Rooms.MaxMessageSize,
+		"connection byte burst must be at least the max message size")
+	check(cfg.RateLimits.UserBytes.Unlimited() || int64(cfg.RateLimits.UserBytes.Burst) >= cfg.Rooms.MaxMessageSize,
+		"user byte burst must be at least the max message size")
+	switch cfg.Storage.Backend {
+	case StorageFile:
+		check(cfg.Storage.Dir != "", "storage directory must be set for file storage")
+	case StorageMemory:
+	default:
+		check(false, "unknown storage backend %q", cfg.Storage.Backend)
+	}
+	check(cfg.Admin.Token == "" || len(cfg.Admin.Token) >= 16, "admin token must be at least 16 characters")
+	check(contains(logLevels, cfg.LogLevel), "log level must be one of %s", strings.Join(logLevels, ", "))
+	check(cfg.LogFormat == LogText || cfg.LogFormat == LogJSON, "log format must be %s or %s", LogText, LogJSON)
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Uses the secret if set, otherwise the key file
+func (cfg Config) SessionKey() ([]byte, error) {
+	if cfg.Session.Secret != "" {
+		return []byte(cfg.Session.Secret), nil
+	}
+	return user.LoadKey(cfg.Session.KeyFile)
+}
+
+// Whether cookies should only be sent over HTTPS
+func (cfg Config) SecureCookies() bool {
+	return cfg.Session.Secure || cfg.TLS.Cert != ""
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
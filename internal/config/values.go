@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/turtlearmy/online-whiteboard/internal/ratelimit"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+// A rate written as "per second/burst", or "0" for no limit. Used in flags,
+// environment variables and the config file
+type Rate ratelimit.Rate
+
+func (r Rate) Rate() ratelimit.Rate {
+	return ratelimit.Rate(r)
+}
+
+func (r Rate) Unlimited() bool {
+	return r.Rate().Unlimited()
+}
+
+func (r *Rate) String() string {
+	if r.Unlimited() {
+		return "0"
+	}
+	return strconv.FormatFloat(r.PerSecond, 'f', -1, 64) + "/" + strconv.FormatFloat(r.Burst, 'f', -1, 64)
+}
+
+func (r *Rate) Set(s string) error {
+	if s == "0" {
+		*r = Rate{}
+		return nil
+	}
+	perSecond, burst, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("rate %q must be written as per second/burst", s)
+	}
+	var err error
+	if r.PerSecond, err = strconv.ParseFloat(perSecond, 64); err != nil {
+		return err
+	}
+	if r.Burst, err = strconv.ParseFloat(burst, 64); err != nil {
+		return err
+	}
+	if r.PerSecond < 0 || r.Burst < 1 {
+		return fmt.Errorf("rate %q must not be negative and must allow a burst of at least 1", s)
+	}
+	return nil
+}
+
+func (r Rate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+func (r *Rate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return r.Set(s)
+}
+
+type policyValue user.Policy
+
+func (p *policyValue) String() string {
+	return string(*p)
+}
+
+func (p *policyValue) Set(s string) error {
+	if !user.Policy(s).Valid() {
+		return fmt.Errorf("unknown backpressure policy %q", s)
+	}
+	*p = policyValue(s)
+	return nil
+}
@@ -0,0 +1,60 @@
+// Package errcode attaches machine readable codes to errors that are reported
+// back to clients
+package errcode
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Code string
+
+const (
+	// The packet couldn't be decoded
+	InvalidPacket Code = "invalid_packet"
+	// The packet was decoded but contains invalid values
+	InvalidArgument Code = "invalid_argument"
+	// The packet refers to a layer or user that doesn't exist
+	NotFound Code = "not_found"
+	// The sender isn't allowed to make the change, e.g. it's not their layer
+	PermissionDenied Code = "permission_denied"
+	// Anything else. Errors without a code are internal
+	Internal Code = "internal"
+)
+
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(code Code, message string) error {
+	return &Error{code, errors.New(message)}
+}
+
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &Error{code, fmt.Errorf(format, a...)}
+}
+
+// Adds a code to an existing error. Returns nil if err is nil
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{code, err}
+}
+
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Internal
+}
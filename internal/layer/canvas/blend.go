@@ -0,0 +1,82 @@
+package canvas
+
+// How pixels being drawn are combined with the pixels already on a canvas.
+// Modes are named after the canvas globalCompositeOperation that gives the
+// same result in browsers
+type BlendMode string
+
+const (
+	// Replaces pixels, including their transparency
+	Copy       BlendMode = "copy"
+	SourceOver BlendMode = "source-over"
+	Multiply   BlendMode = "multiply"
+	Screen     BlendMode = "screen"
+	// Erases pixels by the alpha of the pixels being drawn
+	DestinationOut BlendMode = "destination-out"
+)
+
+// An empty mode is treated as Copy, which was the only behavior before blend
+// modes were added
+func (mode BlendMode) Valid() bool {
+	switch mode {
+	case "", Copy, SourceOver, Multiply, Screen, DestinationOut:
+		return true
+	}
+	return false
+}
+
+// Blends a single non premultiplied source color channel with a backdrop
+// channel. Values are between 0 and 1
+func (mode BlendMode) blendChannel(backdrop, source float64) float64 {
+	switch mode {
+	case Multiply:
+		return backdrop * source
+	case Screen:
+		return backdrop + source - backdrop*source
+	default:
+		return source
+	}
+}
+
+// Composites a single non premultiplied RGBA pixel from src onto dst
+func (mode BlendMode) blendPixel(dst, src []byte) {
+	switch mode {
+	case "", Copy:
+		copy(dst[:4], src[:4])
+		return
+	case DestinationOut:
+		alpha := float64(dst[3]) * (1 - float64(src[3])/0xFF)
+		if alpha == 0 {
+			dst[0], dst[1], dst[2] = 0, 0, 0
+		}
+		dst[3] = toByte(alpha / 0xFF)
+		return
+	}
+
+	srcAlpha := float64(src[3]) / 0xFF
+	dstAlpha := float64(dst[3]) / 0xFF
+	outAlpha := srcAlpha + dstAlpha*(1-srcAlpha)
+	if outAlpha == 0 {
+		dst[0], dst[1], dst[2], dst[3] = 0, 0, 0, 0
+		return
+	}
+	for i := 0; i < 3; i++ {
+		s := float64(src[i]) / 0xFF
+		d := float64(dst[i]) / 0xFF
+		// The blended color only applies where the backdrop is opaque
+		blended := (1-dstAlpha)*s + dstAlpha*mode.blendChannel(d, s)
+		dst[i] = toByte((srcAlpha*blended + dstAlpha*d*(1-srcAlpha)) / outAlpha)
+	}
+	dst[3] = toByte(outAlpha)
+}
+
+// Converts a value between 0 and 1 to a rounded byte
+func toByte(v float64) byte {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 0xFF
+	}
+	return byte(v*0xFF + 0.5)
+}
@@ -1,6 +1,10 @@
 package canvas
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
 
 type Canvas struct {
 	Data   []byte
@@ -9,10 +13,19 @@ type Canvas struct {
 }
 
 const (
-	Width  = 1920
-	Height = 1080
+	DefaultWidth  = 1920
+	DefaultHeight = 1080
+
+	// Largest size a room's canvas can be. Paint layers only allocate the
+	// parts of the canvas they're drawn on, so this can be large
+	MaxWidth  = 16384
+	MaxHeight = 16384
 )
 
+func ValidSize(width, height int) bool {
+	return 0 < width && width <= MaxWidth && 0 < height && height <= MaxHeight
+}
+
 func New(data []byte, width, height int) (Canvas, error) {
 	if len(data) != width*height*4 {
 		return Canvas{}, errors.New("canvas data length does not match width and height")
@@ -32,9 +45,41 @@ func NewTransparent(width, height int) Canvas {
 	return Canvas{make([]byte, width*height*4), width, height}
 }
 
-func (dst *Canvas) Draw(pos Pos, src Canvas) error {
-	if !pos.Positive() || pos.X+src.Width > dst.Width || pos.Y+src.Height > dst.Height {
-		return errors.New("draw is out of bounds")
+// Crops src to the part that is within dst when drawn at pos. Returns false if
+// none of src is within dst
+func (dst *Canvas) Clip(pos Pos, src Canvas) (Pos, Canvas, bool) {
+	return clip(pos, src, dst.Width, dst.Height)
+}
+
+func clip(pos Pos, src Canvas, width, height int) (Pos, Canvas, bool) {
+	minX, minY := max(pos.X, 0), max(pos.Y, 0)
+	maxX, maxY := min(pos.X+src.Width, width), min(pos.Y+src.Height, height)
+	if minX >= maxX || minY >= maxY {
+		return Pos{}, Canvas{}, false
+	}
+	if minX == pos.X && minY == pos.Y && maxX-minX == src.Width && maxY-minY == src.Height {
+		return pos, src, true
+	}
+
+	clipped := NewTransparent(maxX-minX, maxY-minY)
+	clippedByteWidth := clipped.Width * 4
+	srcByteWidth := src.Width * 4
+	for r := 0; r < clipped.Height; r++ {
+		rSrc := r + minY - pos.Y
+		start := rSrc*srcByteWidth + (minX-pos.X)*4
+		copy(clipped.Data[r*clippedByteWidth:(r+1)*clippedByteWidth], src.Data[start:start+clippedByteWidth])
+	}
+	return Pos{minX, minY}, clipped, true
+}
+
+// Any part of src that isn't within dst is ignored
+func (dst *Canvas) Draw(pos Pos, src Canvas, mode BlendMode) error {
+	if !mode.Valid() {
+		return fmt.Errorf("unknown blend mode '%s'", mode)
+	}
+	pos, src, ok := dst.Clip(pos, src)
+	if !ok {
+		return nil
 	}
 
 	srcByteWidth := src.Width * 4
@@ -43,12 +88,22 @@ func (dst *Canvas) Draw(pos Pos, src Canvas) error {
 		rDst := rSrc + pos.Y
 		rowSrc := src.Data[rSrc*srcByteWidth : (rSrc+1)*srcByteWidth]
 		rowDst := dst.Data[rDst*dstByteWidth+pos.X*4:]
-		copy(rowDst, rowSrc)
+		if mode == Copy || mode == "" {
+			copy(rowDst, rowSrc)
+			continue
+		}
+		for i := 0; i < srcByteWidth; i += 4 {
+			mode.blendPixel(rowDst[i:], rowSrc[i:])
+		}
 	}
 
 	return nil
 }
 
+func (c *Canvas) Clone() Canvas {
+	return Canvas{bytes.Clone(c.Data), c.Width, c.Height}
+}
+
 func (dst *Canvas) SetData(data []byte) error {
 	if len(data) != dst.Width*dst.Height*4 {
 		return errors.New("canvas data does not match dimensions")
@@ -56,3 +111,27 @@ func (dst *Canvas) SetData(data []byte) error {
 	copy(dst.Data, data)
 	return nil
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Whether every pixel is fully transparent
+func (c *Canvas) Transparent() bool {
+	for i := 3; i < len(c.Data); i += 4 {
+		if c.Data[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -6,16 +6,31 @@ type Encoded struct {
 	Data   string `json:"data"`
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
+	// How the pixels in Data were encoded before base64. Defaults to RGBA
+	Format Format `json:"format,omitempty"`
 }
 
 func (encoded *Encoded) Decode() (Canvas, error) {
-	image, err := base64.StdEncoding.DecodeString(encoded.Data)
+	data, err := base64.StdEncoding.DecodeString(encoded.Data)
 	if err != nil {
 		return Canvas{}, err
 	}
-	return New(image, encoded.Width, encoded.Height)
+	return Decompress(data, encoded.Format, encoded.Width, encoded.Height)
+}
+
+// Wraps pixels already encoded in format
+func NewEncoded(data []byte, format Format, width, height int) Encoded {
+	return Encoded{base64.StdEncoding.EncodeToString(data), width, height, format}
 }
 
 func (src *Canvas) Encode() Encoded {
-	return Encoded{base64.StdEncoding.EncodeToString(src.Data), src.Width, src.Height}
+	return Encoded{base64.StdEncoding.EncodeToString(src.Data), src.Width, src.Height, RGBA}
+}
+
+func (src *Canvas) EncodeAs(format Format) (Encoded, error) {
+	data, err := src.Compress(format)
+	if err != nil {
+		return Encoded{}, err
+	}
+	return Encoded{base64.StdEncoding.EncodeToString(data), src.Width, src.Height, format}, nil
 }
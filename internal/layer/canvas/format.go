@@ -0,0 +1,151 @@
+package canvas
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+// How pixels are encoded when sent or stored
+type Format string
+
+const (
+	// Uncompressed non premultiplied RGBA, the same as Canvas.Data
+	RGBA Format = "rgba"
+	// RGBA compressed with raw deflate
+	Deflate Format = "deflate"
+	// QOI style run length encoding, which is fast and works well for flat
+	// colors
+	RLE Format = "rle"
+	PNG Format = "png"
+)
+
+// Compressed formats in the order they're preferred for sending images.
+// Deflate is usually smallest for sparse tiles, and unlike png browsers decode
+// it without premultiplying alpha
+var preferredFormats = []Format{Deflate, PNG, RLE}
+
+// An empty format is the same as RGBA
+func (format Format) Valid() bool {
+	switch format {
+	case "", RGBA, Deflate, RLE, PNG:
+		return true
+	}
+	return false
+}
+
+// Picks the most preferred of formats, or RGBA if none are known
+func BestFormat(formats []Format) Format {
+	for _, preferred := range preferredFormats {
+		for _, f := range formats {
+			if f == preferred {
+				return f
+			}
+		}
+	}
+	return RGBA
+}
+
+// Encodes the canvas's pixels in format
+func (src *Canvas) Compress(format Format) ([]byte, error) {
+	switch format {
+	case "", RGBA:
+		return src.Data, nil
+	case Deflate:
+		return deflate(src.Data)
+	case RLE:
+		return encodeRLE(src.Data), nil
+	case PNG:
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+		if err := encoder.Encode(&buf, src.Image()); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown image format '%s'", format)
+}
+
+// Decodes the pixels of a width by height image from data in format
+func Decompress(data []byte, format Format, width, height int) (Canvas, error) {
+	if !ValidSize(width, height) {
+		return Canvas{}, fmt.Errorf("invalid image size %dx%d", width, height)
+	}
+	size := width * height * 4
+	var pixels []byte
+	var err error
+	switch format {
+	case "", RGBA:
+		pixels = data
+	case Deflate:
+		pixels, err = inflate(data, size)
+	case RLE:
+		pixels, err = decodeRLE(data, size)
+	case PNG:
+		pixels, err = decodePNG(data, width, height)
+	default:
+		err = fmt.Errorf("unknown image format '%s'", format)
+	}
+	if err != nil {
+		return Canvas{}, err
+	}
+	return New(pixels, width, height)
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Fails if the data doesn't inflate to exactly size bytes. The result is grown
+// as data is inflated rather than allocated from size, which comes from the
+// sender
+func inflate(data []byte, size int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	// Read one byte more than expected to detect data that is too long
+	inflated, err := io.ReadAll(io.LimitReader(r, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) != size {
+		return nil, errors.New("compressed pixels do not match image dimensions")
+	}
+	return inflated, nil
+}
+
+func decodePNG(data []byte, width, height int) ([]byte, error) {
+	// Check the size before decoding so huge images aren't allocated
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width != width || config.Height != height {
+		return nil, errors.New("png size does not match image dimensions")
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Stride == width*4 {
+		return nrgba.Pix, nil
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Rect, img, img.Bounds().Min, draw.Src)
+	return nrgba.Pix, nil
+}
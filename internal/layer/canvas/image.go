@@ -0,0 +1,13 @@
+package canvas
+
+import "image"
+
+// Wraps the canvas data without copying it. Canvas data is stored as non
+// premultiplied RGBA, the same as browser ImageData
+func (c *Canvas) Image() *image.NRGBA {
+	return &image.NRGBA{
+		Pix:    c.Data,
+		Stride: c.Width * 4,
+		Rect:   image.Rect(0, 0, c.Width, c.Height),
+	}
+}
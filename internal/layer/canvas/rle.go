@@ -0,0 +1,136 @@
+package canvas
+
+import "errors"
+
+// Pixels are encoded with the operations of the QOI image format
+// (https://qoiformat.org), without its header or end marker since the size of
+// images is sent separately
+const (
+	rle_op_index = 0x00 // 00xxxxxx
+	rle_op_diff  = 0x40 // 01xxxxxx
+	rle_op_luma  = 0x80 // 10xxxxxx
+	rle_op_run   = 0xc0 // 11xxxxxx
+	rle_op_rgb   = 0xfe
+	rle_op_rgba  = 0xff
+
+	rle_mask    = 0xc0
+	rle_max_run = 62
+)
+
+type rlePixel struct {
+	r, g, b, a byte
+}
+
+func (p rlePixel) hash() int {
+	return (int(p.r)*3 + int(p.g)*5 + int(p.b)*7 + int(p.a)*11) % 64
+}
+
+func encodeRLE(pixels []byte) []byte {
+	out := make([]byte, 0, len(pixels)/4)
+	var index [64]rlePixel
+	prev := rlePixel{0, 0, 0, 255}
+	run := 0
+
+	for i := 0; i < len(pixels); i += 4 {
+		px := rlePixel{pixels[i], pixels[i+1], pixels[i+2], pixels[i+3]}
+		if px == prev {
+			run++
+			if run == rle_max_run {
+				out = append(out, byte(rle_op_run|(run-1)))
+				run = 0
+			}
+			continue
+		}
+		if run > 0 {
+			out = append(out, byte(rle_op_run|(run-1)))
+			run = 0
+		}
+
+		h := px.hash()
+		switch {
+		case index[h] == px:
+			out = append(out, byte(rle_op_index|h))
+		case px.a == prev.a:
+			index[h] = px
+			dr := int8(px.r - prev.r)
+			dg := int8(px.g - prev.g)
+			db := int8(px.b - prev.b)
+			drg := dr - dg
+			dbg := db - dg
+			if -2 <= dr && dr <= 1 && -2 <= dg && dg <= 1 && -2 <= db && db <= 1 {
+				out = append(out, rle_op_diff|byte(dr+2)<<4|byte(dg+2)<<2|byte(db+2))
+			} else if -32 <= dg && dg <= 31 && -8 <= drg && drg <= 7 && -8 <= dbg && dbg <= 7 {
+				out = append(out, rle_op_luma|byte(dg+32), byte(drg+8)<<4|byte(dbg+8))
+			} else {
+				out = append(out, rle_op_rgb, px.r, px.g, px.b)
+			}
+		default:
+			index[h] = px
+			out = append(out, rle_op_rgba, px.r, px.g, px.b, px.a)
+		}
+		prev = px
+	}
+	if run > 0 {
+		out = append(out, byte(rle_op_run|(run-1)))
+	}
+	return out
+}
+
+// Fails if the data doesn't decode to exactly size bytes
+func decodeRLE(data []byte, size int) ([]byte, error) {
+	errShort := errors.New("run length encoded pixels are truncated")
+	// Grown as pixels are decoded rather than allocated from size, which
+	// comes from the sender. Each op is at least one pixel
+	pixels := make([]byte, 0, min(size, len(data)*4))
+	var index [64]rlePixel
+	px := rlePixel{0, 0, 0, 255}
+
+	for i := 0; i < len(data); {
+		op := data[i]
+		i++
+		run := 1
+		switch {
+		case op == rle_op_rgb:
+			if i+3 > len(data) {
+				return nil, errShort
+			}
+			px.r, px.g, px.b = data[i], data[i+1], data[i+2]
+			i += 3
+		case op == rle_op_rgba:
+			if i+4 > len(data) {
+				return nil, errShort
+			}
+			px = rlePixel{data[i], data[i+1], data[i+2], data[i+3]}
+			i += 4
+		case op&rle_mask == rle_op_index:
+			px = index[op]
+		case op&rle_mask == rle_op_diff:
+			px.r += (op>>4)&3 - 2
+			px.g += (op>>2)&3 - 2
+			px.b += op&3 - 2
+		case op&rle_mask == rle_op_luma:
+			if i >= len(data) {
+				return nil, errShort
+			}
+			dg := op&0x3f - 32
+			px.r += dg - 8 + (data[i]>>4)&0x0f
+			px.g += dg
+			px.b += dg - 8 + data[i]&0x0f
+			i++
+		default:
+			run = int(op&0x3f) + 1
+		}
+		index[px.hash()] = px
+
+		if len(pixels)+run*4 > size {
+			return nil, errors.New("run length encoded pixels do not match image dimensions")
+		}
+		for ; run > 0; run-- {
+			pixels = append(pixels, px.r, px.g, px.b, px.a)
+		}
+	}
+	if len(pixels) != size {
+		return nil, errors.New("run length encoded pixels do not match image dimensions")
+	}
+	return pixels, nil
+}
@@ -0,0 +1,157 @@
+package canvas
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Width and height of tiles. Tiles at the right and bottom edges of a canvas
+// are cropped to the canvas
+const TileSize = 256
+
+// A canvas split into tiles which are only allocated once drawn on. Tiles that
+// aren't allocated are transparent
+type Tiled struct {
+	Width  int
+	Height int
+
+	columns, rows int
+	// Stored row by row. Unallocated tiles are nil
+	tiles []*Canvas
+}
+
+// A non transparent tile of a canvas
+type Tile struct {
+	Pos   Pos
+	Image *Canvas
+}
+
+func NewTiled(width, height int) *Tiled {
+	columns := (width + TileSize - 1) / TileSize
+	rows := (height + TileSize - 1) / TileSize
+	return &Tiled{width, height, columns, rows, make([]*Canvas, columns*rows)}
+}
+
+// Number of tiles the canvas is split into
+func (t *Tiled) TileCount() int {
+	return len(t.tiles)
+}
+
+// Position of the top left corner of a tile
+func (t *Tiled) tilePos(column, row int) Pos {
+	return Pos{column * TileSize, row * TileSize}
+}
+
+func (t *Tiled) newTile(column, row int) *Canvas {
+	pos := t.tilePos(column, row)
+	tile := NewTransparent(min(TileSize, t.Width-pos.X), min(TileSize, t.Height-pos.Y))
+	return &tile
+}
+
+// Any part of src that isn't within the canvas is ignored
+func (t *Tiled) Draw(pos Pos, src Canvas, mode BlendMode) error {
+	if !mode.Valid() {
+		return fmt.Errorf("unknown blend mode '%s'", mode)
+	}
+	pos, src, ok := clip(pos, src, t.Width, t.Height)
+	if !ok {
+		return nil
+	}
+
+	for row := pos.Y / TileSize; row <= (pos.Y+src.Height-1)/TileSize; row++ {
+		for column := pos.X / TileSize; column <= (pos.X+src.Width-1)/TileSize; column++ {
+			i := row*t.columns + column
+			tile := t.tiles[i]
+			if tile == nil {
+				// Erasing can't change a transparent tile
+				if mode == DestinationOut {
+					continue
+				}
+				tile = t.newTile(column, row)
+			}
+			// Draws are clipped to the tile
+			tilePos := t.tilePos(column, row)
+			if err := tile.Draw(Pos{pos.X - tilePos.X, pos.Y - tilePos.Y}, src, mode); err != nil {
+				return err
+			}
+			// Only replacing and erasing can make pixels more transparent
+			if (mode == Copy || mode == "" || mode == DestinationOut) && tile.Transparent() {
+				tile = nil
+			}
+			t.tiles[i] = tile
+		}
+	}
+	return nil
+}
+
+// Replaces the whole canvas
+func (t *Tiled) SetData(data []byte) error {
+	if len(data) != t.Width*t.Height*4 {
+		return errors.New("canvas data does not match dimensions")
+	}
+	return t.Draw(Pos{0, 0}, Canvas{data, t.Width, t.Height}, Copy)
+}
+
+// Gets every tile that isn't transparent
+func (t *Tiled) Tiles() []Tile {
+	tiles := []Tile{}
+	for i, tile := range t.tiles {
+		if tile != nil {
+			tiles = append(tiles, Tile{t.tilePos(i%t.columns, i/t.columns), tile})
+		}
+	}
+	return tiles
+}
+
+// Copies the tiles into a single canvas
+func (t *Tiled) Dense() Canvas {
+	dense := NewTransparent(t.Width, t.Height)
+	for _, tile := range t.Tiles() {
+		dense.Draw(tile.Pos, *tile.Image, Copy)
+	}
+	return dense
+}
+
+func (t *Tiled) Encode() Encoded {
+	dense := t.Dense()
+	return dense.Encode()
+}
+
+// Creates a copy of the canvas cropped or extended to the new size, anchored
+// to the top left corner
+func (t *Tiled) Resized(width, height int) *Tiled {
+	resized := NewTiled(width, height)
+	for _, tile := range t.Tiles() {
+		resized.Draw(tile.Pos, *tile.Image, Copy)
+	}
+	return resized
+}
+
+// Copies every allocated tile
+func (t *Tiled) Clone() *Tiled {
+	clone := &Tiled{t.Width, t.Height, t.columns, t.rows, make([]*Canvas, len(t.tiles))}
+	for i, tile := range t.tiles {
+		if tile != nil {
+			c := tile.Clone()
+			clone.tiles[i] = &c
+		}
+	}
+	return clone
+}
+
+// Number of bytes used by allocated tiles
+func (t *Tiled) MemoryUsage() int {
+	usage := 0
+	for _, tile := range t.tiles {
+		if tile != nil {
+			usage += len(tile.Data)
+		}
+	}
+	return usage
+}
+
+// Crops src to the part that is within the canvas when drawn at pos. Returns
+// false if none of src is within the canvas
+func (t *Tiled) Clip(pos Pos, src Canvas) (Pos, Canvas, bool) {
+	return clip(pos, src, t.Width, t.Height)
+}
@@ -13,6 +13,13 @@ type Layer interface {
 	SetOwner(user user.Id)
 	Name() string
 	SetName(name string)
+	// Used to save and restore the type specific contents of a layer, such as
+	// the canvas of a paint layer
+	MarshalContents() ([]byte, error)
+	UnmarshalContents(data []byte) error
+	// Deep copy of the layer, which can be used outside of the room's
+	// goroutine while the layer keeps changing
+	Clone() Layer
 }
 
 type Handler interface {
@@ -1,8 +1,7 @@
 package layer
 
 import (
-	"fmt"
-
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
 
@@ -10,9 +9,25 @@ type Manager struct {
 	// Stored in order of top to bottom. Height 0 is the top layer
 	Layers []Layer
 
+	// Size of the canvas all layers are drawn on
+	Width, Height int
+
 	nextId Id
 }
 
+func NewManager(width, height int) *Manager {
+	return &Manager{Width: width, Height: height}
+}
+
+// Deep copy of every layer, which can be used outside of the room's goroutine
+func (layers *Manager) Clone() *Manager {
+	clone := &Manager{Layers: make([]Layer, 0, len(layers.Layers)), Width: layers.Width, Height: layers.Height, nextId: layers.nextId}
+	for _, l := range layers.Layers {
+		clone.Layers = append(clone.Layers, l.Clone())
+	}
+	return clone
+}
+
 func (layers *Manager) validHeight(i int) bool {
 	return 0 <= i && i < len(layers.Layers)
 }
@@ -34,7 +49,7 @@ func (layers *Manager) Get(id Id) (l Layer, height int) {
 func (layers *Manager) GetOwned(id Id, owner user.Id, action string) (l Layer, height int, err error) {
 	l, height, err = layers.GetOwnedOrUnowned(id, owner, action)
 	if err == nil && l.Owner() == 0 {
-		return nil, 0, fmt.Errorf("user %d attempted to %s unowned layer %d", owner, action, id)
+		return nil, 0, errcode.Errorf(errcode.PermissionDenied, "user %d attempted to %s unowned layer %d", owner, action, id)
 	}
 	return
 }
@@ -42,11 +57,11 @@ func (layers *Manager) GetOwned(id Id, owner user.Id, action string) (l Layer, h
 func (layers *Manager) GetOwnedOrUnowned(id Id, owner user.Id, action string) (l Layer, height int, err error) {
 	l, height = layers.Get(id)
 	if l == nil {
-		return nil, 0, fmt.Errorf("user %d attempted to %s non-existant layer %d", owner, action, id)
+		return nil, 0, errcode.Errorf(errcode.NotFound, "user %d attempted to %s non-existant layer %d", owner, action, id)
 	}
 	// Unowned layers have an owner of 0
 	if l.Owner() != owner && l.Owner() != 0 {
-		return nil, 0, fmt.Errorf("user %d attempted to %s layer %d owned by user %d", owner, action, id, l.Owner())
+		return nil, 0, errcode.Errorf(errcode.PermissionDenied, "user %d attempted to %s layer %d owned by user %d", owner, action, id, l.Owner())
 	}
 	return
 }
@@ -113,7 +128,7 @@ func GetOwnedOfType[T Layer](layers *Manager, id Id, owner user.Id, action strin
 	}
 	l, ok := gotLayer.(T)
 	if !ok {
-		err = fmt.Errorf("user %d attempted to %s %s %d, but got a %s", owner, action, l.LayerType(), id, gotLayer.LayerType())
+		err = errcode.Errorf(errcode.InvalidArgument, "user %d attempted to %s %s %d, but got a %s", owner, action, l.LayerType(), id, gotLayer.LayerType())
 	}
 	return
 }
@@ -0,0 +1,19 @@
+package layer
+
+// Implemented by layers that keep their contents in memory, such as paint
+// layers
+type MemoryUser interface {
+	// Number of bytes used by the layer's contents
+	MemoryUsage() int
+}
+
+// Number of bytes used by the contents of every layer
+func (layers *Manager) MemoryUsage() int {
+	usage := 0
+	for _, l := range layers.Layers {
+		if m, ok := l.(MemoryUser); ok {
+			usage += m.MemoryUsage()
+		}
+	}
+	return usage
+}
@@ -2,6 +2,7 @@ package layerpackets
 
 import (
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
 
 const c2s_packet_type_layer_delete = "s2c_delete_layer"
@@ -11,3 +12,7 @@ type s2cDeletePacket layer.Id
 func (s2cDeletePacket) PacketType() string {
 	return c2s_packet_type_layer_delete
 }
+
+func NewS2CDeletePacket(id layer.Id) user.OutgoingPacket {
+	return s2cDeletePacket(id)
+}
@@ -1,9 +1,8 @@
 package layerpackets
 
 import (
-	"fmt"
-
 	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
@@ -15,6 +14,11 @@ type setOwnerPacket struct {
 	NewOwner user.Id  `json:"new_owner"`
 }
 
+// Tells clients a layer's owner changed
+func NewSetOwnerPacket(id layer.Id, owner user.Id) user.OutgoingPacket {
+	return &setOwnerPacket{id, owner}
+}
+
 var _ = c2s.Register(type_layer_set_owner, func() layer.Handler { return new(setOwnerPacket) })
 
 func (*setOwnerPacket) PacketType() string {
@@ -28,7 +32,7 @@ func (p *setOwnerPacket) Handle(layers *layer.Manager, users *user.Manager, send
 	}
 	// This prevents users setting other users as the owner of an unowned layer
 	if layer.Owner() != sender && p.NewOwner != sender {
-		return nil, fmt.Errorf("user %d attempted to set user %d as owner of unowned layer %d", sender, p.NewOwner, p.Layer)
+		return nil, errcode.Errorf(errcode.PermissionDenied, "user %d attempted to set user %d as owner of unowned layer %d", sender, p.NewOwner, p.Layer)
 	}
 	layer.SetOwner(p.NewOwner)
 
@@ -0,0 +1,235 @@
+package paintlayer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+)
+
+// Binary forms of paint layer packets, which avoid the overhead of base64 and
+// json for pixel data. The format is documented in the README
+const (
+	binary_type_draw byte = 1
+	binary_type_set  byte = 2
+
+	// Set on set packets that clear the layer before drawing their rectangles
+	binary_flag_clear byte = 1
+
+	// Not including the type and request id, which are read by c2s
+	binary_header_size      = 11
+	binary_rect_header_size = 20
+
+	// Enough rectangles for every tile of the largest canvas
+	binary_max_rects = (canvas.MaxWidth / canvas.TileSize) * (canvas.MaxHeight / canvas.TileSize)
+)
+
+// Blend modes are sent as their index
+var binaryBlendModes = []canvas.BlendMode{
+	canvas.Copy,
+	canvas.SourceOver,
+	canvas.Multiply,
+	canvas.Screen,
+	canvas.DestinationOut,
+}
+
+// Pixel formats are sent as their index
+var binaryFormats = []canvas.Format{
+	canvas.RGBA,
+	canvas.Deflate,
+	canvas.RLE,
+	canvas.PNG,
+}
+
+var _ = c2s.RegisterBinary(binary_type_draw, packet_type_paint_layer_draw, decodeBinaryDraw)
+var _ = c2s.RegisterBinary(binary_type_set, packet_type_paint_layer_set, decodeBinarySet)
+
+type binaryHeader struct {
+	mode   byte
+	format canvas.Format
+	flags  byte
+	layer  layer.Id
+}
+
+type binaryRect struct {
+	pos   canvas.Pos
+	image canvas.Canvas
+}
+
+// Pixels are sent in format unless they're small enough that compressing them
+// isn't worth it
+func marshalBinary(header binaryHeader, rects []binaryRect, format canvas.Format) ([]byte, error) {
+	size := 0
+	for _, r := range rects {
+		size += len(r.image.Data)
+	}
+	header.format = compressedFormat(size, format)
+
+	buf := bytes.NewBuffer(make([]byte, 0, binary_header_size+len(rects)*binary_rect_header_size+size))
+	buf.Write([]byte{header.mode, formatCode(header.format), header.flags})
+	binary.Write(buf, binary.BigEndian, uint32(header.layer))
+	binary.Write(buf, binary.BigEndian, uint32(len(rects)))
+	for _, r := range rects {
+		pixels, err := r.image.Compress(header.format)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(buf, binary.BigEndian, []int32{int32(r.pos.X), int32(r.pos.Y)})
+		binary.Write(buf, binary.BigEndian, []uint32{
+			uint32(r.image.Width),
+			uint32(r.image.Height),
+			uint32(len(pixels)),
+		})
+		buf.Write(pixels)
+	}
+	return buf.Bytes(), nil
+}
+
+// Pixels are left encoded, so they're only decoded once the packet is handled
+// and they can be checked against the size of the layer
+func unmarshalBinary(data []byte) (binaryHeader, []tile, error) {
+	if len(data) < binary_header_size {
+		return binaryHeader{}, nil, errors.New("binary packet is too short")
+	}
+	if int(data[1]) >= len(binaryFormats) {
+		return binaryHeader{}, nil, fmt.Errorf("unknown binary pixel format %d", data[1])
+	}
+	header := binaryHeader{
+		mode:   data[0],
+		format: binaryFormats[data[1]],
+		flags:  data[2],
+		layer:  layer.Id(binary.BigEndian.Uint32(data[3:])),
+	}
+	count := binary.BigEndian.Uint32(data[7:])
+	if count > binary_max_rects {
+		return binaryHeader{}, nil, fmt.Errorf("binary packet has too many rectangles (%d)", count)
+	}
+	data = data[binary_header_size:]
+
+	rects := make([]tile, 0, min(count, uint32(len(data)/binary_rect_header_size)))
+	for i := uint32(0); i < count; i++ {
+		if len(data) < binary_rect_header_size {
+			return binaryHeader{}, nil, errors.New("binary packet is too short")
+		}
+		x := int32(binary.BigEndian.Uint32(data[0:]))
+		y := int32(binary.BigEndian.Uint32(data[4:]))
+		width := binary.BigEndian.Uint32(data[8:])
+		height := binary.BigEndian.Uint32(data[12:])
+		length := binary.BigEndian.Uint32(data[16:])
+		data = data[binary_rect_header_size:]
+		if width > canvas.MaxWidth || height > canvas.MaxHeight {
+			return binaryHeader{}, nil, fmt.Errorf("binary packet image is too large (%dx%d)", width, height)
+		}
+		if uint32(len(data)) < length {
+			return binaryHeader{}, nil, errors.New("binary packet is too short")
+		}
+
+		image := canvas.NewEncoded(data[:length], header.format, int(width), int(height))
+		data = data[length:]
+		rects = append(rects, tile{Pos: canvas.Pos{X: int(x), Y: int(y)}, Image: image})
+	}
+	if len(data) != 0 {
+		return binaryHeader{}, nil, errors.New("binary packet has trailing data")
+	}
+	return header, rects, nil
+}
+
+func blendModeCode(mode canvas.BlendMode) byte {
+	for i, m := range binaryBlendModes {
+		if m == mode {
+			return byte(i)
+		}
+	}
+	// An empty mode is the same as copy
+	return 0
+}
+
+func formatCode(format canvas.Format) byte {
+	for i, f := range binaryFormats {
+		if f == format {
+			return byte(i)
+		}
+	}
+	// An empty format is the same as RGBA
+	return 0
+}
+
+func decodeBinaryDraw(data []byte) (layer.Handler, error) {
+	header, rects, err := unmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rects) != 1 {
+		return nil, fmt.Errorf("binary draw packet has %d rectangles instead of 1", len(rects))
+	}
+	if int(header.mode) >= len(binaryBlendModes) {
+		return nil, fmt.Errorf("unknown binary blend mode %d", header.mode)
+	}
+	return &DrawPacket{
+		Pos:   rects[0].Pos,
+		Image: rects[0].Image,
+		Layer: header.layer,
+		Mode:  binaryBlendModes[header.mode],
+	}, nil
+}
+
+func (*DrawPacket) BinaryType() byte {
+	return binary_type_draw
+}
+
+func (packet *DrawPacket) EncodeBinary(format canvas.Format) ([]byte, error) {
+	image, err := decodeCached(packet.image, &packet.Image)
+	if err != nil {
+		return nil, err
+	}
+	header := binaryHeader{mode: blendModeCode(packet.Mode), layer: packet.Layer}
+	return marshalBinary(header, []binaryRect{{packet.Pos, image}}, format)
+}
+
+func decodeBinarySet(data []byte) (layer.Handler, error) {
+	header, rects, err := unmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	packet := &setPacket{LayerId: header.layer}
+	if header.flags&binary_flag_clear != 0 {
+		packet.Tiles = rects
+		return packet, nil
+	}
+	if len(rects) != 1 || rects[0].Pos != (canvas.Pos{}) {
+		return nil, errors.New("binary set packet without tiles must have a single rectangle at 0, 0")
+	}
+	packet.Image = &rects[0].Image
+	return packet, nil
+}
+
+func (*setPacket) BinaryType() byte {
+	return binary_type_set
+}
+
+func (packet *setPacket) EncodeBinary(format canvas.Format) ([]byte, error) {
+	header := binaryHeader{layer: packet.LayerId}
+	if packet.Image != nil {
+		image, err := decodeCached(packet.image, packet.Image)
+		if err != nil {
+			return nil, err
+		}
+		return marshalBinary(header, []binaryRect{{canvas.Pos{}, image}}, format)
+	}
+
+	header.flags |= binary_flag_clear
+	rects := make([]binaryRect, 0, len(packet.Tiles))
+	for i := range packet.Tiles {
+		t := &packet.Tiles[i]
+		image, err := decodeCached(t.image, &t.Image)
+		if err != nil {
+			return nil, err
+		}
+		rects = append(rects, binaryRect{t.Pos, image})
+	}
+	return marshalBinary(header, rects, format)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 
 	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
@@ -15,6 +16,11 @@ type DrawPacket struct {
 	Pos   canvas.Pos     `json:"pos"`
 	Image canvas.Encoded `json:"image"`
 	Layer layer.Id       `json:"layer"`
+	// Defaults to replacing pixels if not set
+	Mode canvas.BlendMode `json:"mode,omitempty"`
+
+	// Decoded Image, set once the packet has been handled
+	image *canvas.Canvas
 }
 
 var _ = c2s.Register(packet_type_paint_layer_draw, func() layer.Handler { return &DrawPacket{} })
@@ -23,21 +29,60 @@ func (packet *DrawPacket) PacketType() string {
 	return packet_type_paint_layer_draw
 }
 
+func (packet *DrawPacket) ContentLayer() uint32 {
+	return uint32(packet.Layer)
+}
+
 func (packet *DrawPacket) Handle(layers *layer.Manager, users *user.Manager, sender user.Id) (user.OutgoingPacket, error) {
 	paintLayer, _, err := layer.GetOwnedOfType[*paintLayer](layers, packet.Layer, sender, "paint on")
 	if err != nil {
 		return nil, err
 	}
-	image, err := packet.Image.Decode()
-	if err != nil {
+	if err := checkSize(&packet.Image, paintLayer.canvas.Width, paintLayer.canvas.Height); err != nil {
 		return nil, err
 	}
-	if err := paintLayer.canvas.Draw(packet.Pos, image); err != nil {
+	image, err := decodeCached(packet.image, &packet.Image)
+	if err != nil {
+		return nil, errcode.Wrap(errcode.InvalidArgument, err)
+	}
+	if !packet.Mode.Valid() {
+		return nil, errcode.Errorf(errcode.InvalidArgument, "unknown blend mode '%s'", packet.Mode)
+	}
+	// Broadcast only the part of the draw that was within the canvas, so
+	// clients end up with the same result as the server
+	pos, image, ok := paintLayer.canvas.Clip(packet.Pos, image)
+	if !ok {
+		return nil, nil
+	}
+	if pos != packet.Pos || image.Width != packet.Image.Width || image.Height != packet.Image.Height {
+		packet.Pos = pos
+		packet.Image = image.Encode()
+	}
+	packet.image = &image
+	if err := paintLayer.canvas.Draw(packet.Pos, image, packet.Mode); err != nil {
 		return nil, err
 	}
 	return packet, nil
 }
 
+func (packet *DrawPacket) MemoryUsage() int {
+	size := len(packet.Image.Data)
+	if packet.image != nil {
+		size += len(packet.image.Data)
+	}
+	return size
+}
+
+func (packet *DrawPacket) WithFormat(format canvas.Format) (user.OutgoingPacket, error) {
+	encoded, err := reencode(packet.image, packet.Image, format)
+	if err != nil {
+		return nil, err
+	}
+	p := *packet
+	p.Image = encoded
+	return &p, nil
+}
+
 func (packet *DrawPacket) Encoded() ([]byte, error) {
 	return json.Marshal(map[string]interface{}{"type": packet_type_paint_layer_draw, "data": packet})
 }
@@ -0,0 +1,57 @@
+package paintlayer
+
+import (
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+)
+
+// Images with fewer bytes of pixels than this are sent uncompressed, since
+// compressing them saves little
+const compress_threshold = 1024
+
+func compressedFormat(size int, format canvas.Format) canvas.Format {
+	if size < compress_threshold {
+		return canvas.RGBA
+	}
+	return format
+}
+
+// Checks the size an image says it is before it's decoded, since that's how
+// much decoding it allocates
+func checkSize(image *canvas.Encoded, maxWidth, maxHeight int) error {
+	if image.Width > maxWidth || image.Height > maxHeight {
+		return errcode.Errorf(errcode.InvalidArgument, "image of %dx%d is larger than %dx%d", image.Width, image.Height, maxWidth, maxHeight)
+	}
+	return nil
+}
+
+// Uses the already decoded image if there is one
+func decodeCached(cached *canvas.Canvas, encoded *canvas.Encoded) (canvas.Canvas, error) {
+	if cached != nil {
+		return *cached, nil
+	}
+	return encoded.Decode()
+}
+
+// Encodes an image in format, reusing encoded if it's already in that format
+func reencode(cached *canvas.Canvas, encoded canvas.Encoded, format canvas.Format) (canvas.Encoded, error) {
+	image, err := decodeCached(cached, &encoded)
+	if err != nil {
+		return canvas.Encoded{}, err
+	}
+	format = compressedFormat(len(image.Data), format)
+	if encoded.Data != "" && sameFormat(encoded.Format, format) {
+		return encoded, nil
+	}
+	return image.EncodeAs(format)
+}
+
+func sameFormat(a, b canvas.Format) bool {
+	if a == "" {
+		a = canvas.RGBA
+	}
+	if b == "" {
+		b = canvas.RGBA
+	}
+	return a == b
+}
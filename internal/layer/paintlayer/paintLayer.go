@@ -1,7 +1,10 @@
 package paintlayer
 
 import (
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/draw"
 
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
@@ -12,17 +15,17 @@ const LAYER_TYPE layer.Type = "paint_layer"
 
 type paintLayer struct {
 	layer.LayerInfo
-	canvas canvas.Canvas
+	canvas *canvas.Tiled
 }
 
-func NewPaintLayer(id layer.Id, owner user.Id) layer.Layer {
+func NewPaintLayer(id layer.Id, owner user.Id, width, height int) layer.Layer {
 	return &paintLayer{
 		layer.LayerInfo{
 			LayerId:    id,
 			LayerOwner: owner,
 			LayerName:  fmt.Sprintf("Paint Layer %d", id),
 		},
-		canvas.NewTransparent(canvas.Width, canvas.Height),
+		canvas.NewTiled(width, height),
 	}
 }
 
@@ -32,6 +35,68 @@ func (l *paintLayer) LayerType() layer.Type {
 	return LAYER_TYPE
 }
 
+// Only tiles that have been drawn on are sent
 func (l *paintLayer) InitPacket() user.OutgoingPacket {
-	return &setPacket{l.canvas.Encode(), l.Id()}
+	return &setPacket{Tiles: newTiles(l.canvas.Tiles()), LayerId: l.Id()}
+}
+
+type contents struct {
+	Tiles []tile `json:"tiles"`
+	// Rooms saved before layers were tiled stored the whole canvas instead
+	canvas.Encoded
+}
+
+func (l *paintLayer) MarshalContents() ([]byte, error) {
+	// Tiles are mostly transparent, so they compress well
+	tiles, err := encodeTiles(l.canvas.Tiles(), canvas.Deflate)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(contents{Tiles: tiles})
+}
+
+func (l *paintLayer) UnmarshalContents(data []byte) error {
+	var c contents
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	if c.Data != "" {
+		image, err := c.Decode()
+		if err != nil {
+			return err
+		}
+		if err := l.canvas.SetData(image.Data); err != nil {
+			return err
+		}
+	}
+	return drawTiles(l.canvas, c.Tiles)
+}
+
+func (l *paintLayer) Clone() layer.Layer {
+	return &paintLayer{l.LayerInfo, l.canvas.Clone()}
+}
+
+func (l *paintLayer) Rasterize(dst draw.Image) {
+	for _, tile := range l.canvas.Tiles() {
+		img := tile.Image.Image()
+		r := img.Bounds().Add(image.Pt(tile.Pos.X, tile.Pos.Y))
+		draw.Draw(dst, r, img, image.Point{}, draw.Over)
+	}
+}
+
+func (l *paintLayer) SetImage(img image.Image) {
+	bounds := img.Bounds()
+	src := canvas.NewTransparent(bounds.Dx(), bounds.Dy())
+	dst := src.Image()
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	l.canvas = canvas.NewTiled(l.canvas.Width, l.canvas.Height)
+	l.canvas.Draw(canvas.Pos{X: bounds.Min.X, Y: bounds.Min.Y}, src, canvas.Copy)
+}
+
+func (l *paintLayer) Resize(width, height int) {
+	l.canvas = l.canvas.Resized(width, height)
+}
+
+func (l *paintLayer) MemoryUsage() int {
+	return l.canvas.MemoryUsage()
 }
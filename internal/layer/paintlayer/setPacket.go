@@ -2,6 +2,7 @@ package paintlayer
 
 import (
 	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
@@ -9,9 +10,15 @@ import (
 
 const packet_type_paint_layer_set = "paint_layer_set"
 
+// Either replaces the layer starting from its top left corner with Image, or
+// if Tiles is set clears the layer and draws each tile
 type setPacket struct {
-	Image   canvas.Encoded `json:"image"`
-	LayerId layer.Id       `json:"layer"`
+	Image   *canvas.Encoded `json:"image,omitempty"`
+	Tiles   []tile          `json:"tiles"`
+	LayerId layer.Id        `json:"layer"`
+
+	// Decoded Image, set once the packet has been handled
+	image *canvas.Canvas
 }
 
 var _ = c2s.Register(packet_type_paint_layer_set, func() layer.Handler { return &setPacket{} })
@@ -20,17 +27,92 @@ func (*setPacket) PacketType() string {
 	return packet_type_paint_layer_set
 }
 
+func (packet *setPacket) ContentLayer() uint32 {
+	return uint32(packet.LayerId)
+}
+
 func (packet *setPacket) Handle(layers *layer.Manager, users *user.Manager, sender user.Id) (user.OutgoingPacket, error) {
 	paintLayer, _, err := layer.GetOwnedOfType[*paintLayer](layers, packet.LayerId, sender, "set contents of")
 	if err != nil {
 		return nil, err
 	}
-	image, err := packet.Image.Decode()
-	if err != nil {
+	if packet.Image == nil {
+		// Make sure clients clear the layer even if no tiles were sent
+		if packet.Tiles == nil {
+			packet.Tiles = []tile{}
+		}
+		if count := paintLayer.canvas.TileCount(); len(packet.Tiles) > count {
+			return nil, errcode.Errorf(errcode.InvalidArgument, "%d tiles is more than the layer's %d", len(packet.Tiles), count)
+		}
+		for i := range packet.Tiles {
+			if err := checkSize(&packet.Tiles[i].Image, canvas.TileSize, canvas.TileSize); err != nil {
+				return nil, err
+			}
+		}
+		// Decode every tile before clearing so invalid tiles don't leave the
+		// layer half set
+		cleared := canvas.NewTiled(paintLayer.canvas.Width, paintLayer.canvas.Height)
+		if err := drawTiles(cleared, packet.Tiles); err != nil {
+			return nil, errcode.Wrap(errcode.InvalidArgument, err)
+		}
+		paintLayer.canvas = cleared
+		return packet, nil
+	}
+
+	if err := checkSize(packet.Image, paintLayer.canvas.Width, paintLayer.canvas.Height); err != nil {
 		return nil, err
 	}
-	if err := paintLayer.canvas.Draw(canvas.Pos{X: 0, Y: 0}, image); err != nil {
+	image, err := decodeCached(packet.image, packet.Image)
+	if err != nil {
+		return nil, errcode.Wrap(errcode.InvalidArgument, err)
+	}
+	// Broadcast only the part of the image that was within the canvas
+	_, image, ok := paintLayer.canvas.Clip(canvas.Pos{X: 0, Y: 0}, image)
+	if !ok {
+		return nil, nil
+	}
+	if image.Width != packet.Image.Width || image.Height != packet.Image.Height {
+		encoded := image.Encode()
+		packet.Image = &encoded
+	}
+	packet.image = &image
+	if err := paintLayer.canvas.Draw(canvas.Pos{X: 0, Y: 0}, image, canvas.Copy); err != nil {
 		return nil, err
 	}
 	return packet, nil
 }
+
+func (packet *setPacket) MemoryUsage() int {
+	size := 0
+	if packet.Image != nil {
+		size += len(packet.Image.Data)
+	}
+	if packet.image != nil {
+		size += len(packet.image.Data)
+	}
+	for i := range packet.Tiles {
+		size += packet.Tiles[i].memoryUsage()
+	}
+	return size
+}
+
+func (packet *setPacket) WithFormat(format canvas.Format) (user.OutgoingPacket, error) {
+	p := *packet
+	if packet.Image != nil {
+		encoded, err := reencode(packet.image, *packet.Image, format)
+		if err != nil {
+			return nil, err
+		}
+		p.Image = &encoded
+		return &p, nil
+	}
+	p.Tiles = make([]tile, 0, len(packet.Tiles))
+	for _, t := range packet.Tiles {
+		encoded, err := reencode(t.image, t.Image, format)
+		if err != nil {
+			return nil, err
+		}
+		p.Tiles = append(p.Tiles, tile{t.Pos, encoded, t.image})
+	}
+	return &p, nil
+}
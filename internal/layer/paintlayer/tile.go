@@ -0,0 +1,59 @@
+package paintlayer
+
+import "github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+
+type tile struct {
+	Pos   canvas.Pos     `json:"pos"`
+	Image canvas.Encoded `json:"image"`
+
+	// Decoded Image, if it is already known
+	image *canvas.Canvas
+}
+
+// Tiles are only encoded once the format they're sent in is known, which may
+// be after the layer changes, so they're copied
+func newTiles(tiles []canvas.Tile) []tile {
+	wrapped := make([]tile, 0, len(tiles))
+	for _, t := range tiles {
+		image := t.Image.Clone()
+		wrapped = append(wrapped, tile{Pos: t.Pos, image: &image})
+	}
+	return wrapped
+}
+
+func (t *tile) memoryUsage() int {
+	size := len(t.Image.Data)
+	if t.image != nil {
+		size += len(t.image.Data)
+	}
+	return size
+}
+
+func encodeTiles(tiles []canvas.Tile, format canvas.Format) ([]tile, error) {
+	encoded := make([]tile, 0, len(tiles))
+	for _, t := range tiles {
+		image, err := t.Image.EncodeAs(format)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, tile{t.Pos, image, t.Image})
+	}
+	return encoded, nil
+}
+
+func drawTiles(dst *canvas.Tiled, tiles []tile) error {
+	for i := range tiles {
+		t := &tiles[i]
+		image, err := decodeCached(t.image, &t.Image)
+		if err != nil {
+			return err
+		}
+		// Keep the decoded image so it isn't decoded again if the tiles are
+		// sent on
+		t.image = &image
+		if err := dst.Draw(t.Pos, image, canvas.Copy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
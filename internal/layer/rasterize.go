@@ -0,0 +1,32 @@
+package layer
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Implemented by layers that can be drawn onto an image, such as for exports
+type Rasterizer interface {
+	// Draws the layer over the contents of dst
+	Rasterize(dst draw.Image)
+}
+
+// Composites every layer from bottom to top into a single image. Layers that
+// can't be rasterized are skipped
+func (layers *Manager) Flatten() *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, layers.Width, layers.Height))
+	for i := len(layers.Layers) - 1; i >= 0; i-- {
+		if r, ok := layers.Layers[i].(Rasterizer); ok {
+			r.Rasterize(dst)
+		}
+	}
+	return dst
+}
+
+// Implemented by layers whose contents are entirely an image, such as paint
+// layers
+type ImageSetter interface {
+	// Replaces the contents of the layer with img, drawn at its bounds. The
+	// rest of the layer is cleared
+	SetImage(img image.Image)
+}
@@ -1,14 +1,14 @@
 package layer
 
 import (
-	"fmt"
-
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
 
-var registry = map[Type]func(id Id, owner user.Id) Layer{}
+// Layers are constructed with the size of the canvas of the room they are in
+var registry = map[Type]func(id Id, owner user.Id, width, height int) Layer{}
 
-func Register(layerType Type, constructor func(id Id, owner user.Id) Layer) error {
+func Register(layerType Type, constructor func(id Id, owner user.Id, width, height int) Layer) error {
 	registry[layerType] = constructor
 	return nil
 }
@@ -16,8 +16,8 @@ func Register(layerType Type, constructor func(id Id, owner user.Id) Layer) erro
 func (layers *Manager) CreateLayer(layerType Type, owner user.Id) (Layer, error) {
 	constructor, ok := registry[layerType]
 	if !ok {
-		return nil, fmt.Errorf("unknown layer type '%s'", layerType)
+		return nil, errcode.Errorf(errcode.InvalidArgument, "unknown layer type '%s'", layerType)
 	}
 	layers.nextId++
-	return constructor(layers.nextId, owner), nil
+	return constructor(layers.nextId, owner, layers.Width, layers.Height), nil
 }
@@ -0,0 +1,17 @@
+package layer
+
+// Implemented by layers with contents that depend on the size of the canvas
+type Resizer interface {
+	// Crops or extends the layer's contents, keeping them anchored to the top
+	// left corner
+	Resize(width, height int)
+}
+
+func (layers *Manager) Resize(width, height int) {
+	layers.Width, layers.Height = width, height
+	for _, l := range layers.Layers {
+		if r, ok := l.(Resizer); ok {
+			r.Resize(width, height)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+// Serializable state of a single layer
+type Snapshot struct {
+	Type     Type            `json:"type"`
+	Id       Id              `json:"id"`
+	Owner    user.Id         `json:"owner"`
+	Name     string          `json:"name"`
+	Contents json.RawMessage `json:"contents"`
+}
+
+// Serializable state of a manager. Layers are stored in order of top to bottom
+type ManagerSnapshot struct {
+	Layers []Snapshot `json:"layers"`
+	Width  int        `json:"width"`
+	Height int        `json:"height"`
+	NextId Id         `json:"next_id"`
+}
+
+func (layers *Manager) Snapshot() (ManagerSnapshot, error) {
+	snapshot := ManagerSnapshot{make([]Snapshot, 0, len(layers.Layers)), layers.Width, layers.Height, layers.nextId}
+	for _, l := range layers.Layers {
+		contents, err := l.MarshalContents()
+		if err != nil {
+			return ManagerSnapshot{}, fmt.Errorf("error saving contents of layer %d: %w", l.Id(), err)
+		}
+		snapshot.Layers = append(snapshot.Layers, Snapshot{l.LayerType(), l.Id(), l.Owner(), l.Name(), contents})
+	}
+	return snapshot, nil
+}
+
+func RestoreManager(snapshot ManagerSnapshot) (*Manager, error) {
+	layers := &Manager{Width: snapshot.Width, Height: snapshot.Height, nextId: snapshot.NextId}
+	// Rooms saved before canvas sizes could be chosen used the default size
+	if layers.Width == 0 || layers.Height == 0 {
+		layers.Width, layers.Height = canvas.DefaultWidth, canvas.DefaultHeight
+	}
+	for _, s := range snapshot.Layers {
+		constructor, ok := registry[s.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown layer type '%s'", s.Type)
+		}
+		l := constructor(s.Id, s.Owner, layers.Width, layers.Height)
+		l.SetName(s.Name)
+		if err := l.UnmarshalContents(s.Contents); err != nil {
+			return nil, fmt.Errorf("error restoring contents of layer %d: %w", s.Id, err)
+		}
+		layers.Add(l)
+		// Make sure new layers never reuse the id of a restored one
+		if s.Id > layers.nextId {
+			layers.nextId = s.Id
+		}
+	}
+	return layers, nil
+}
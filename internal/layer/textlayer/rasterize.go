@@ -0,0 +1,64 @@
+package textlayer
+
+import (
+	"image"
+	"image/draw"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	parseFontOnce sync.Once
+	textFont      *opentype.Font
+)
+
+// Clients render text with the browser's serif font, which the server has no
+// access to, so text is approximated with the Go font
+func getFont() *opentype.Font {
+	parseFontOnce.Do(func() {
+		var err error
+		if textFont, err = opentype.Parse(goregular.TTF); err != nil {
+			slog.Error("error parsing text layer font", "err", err)
+		}
+	})
+	return textFont
+}
+
+func (l *textLayer) Rasterize(dst draw.Image) {
+	f := getFont()
+	if f == nil || l.Text.TextContent == "" || l.Text.FontSize <= 0 {
+		return
+	}
+	// Text from saved rooms and imports hasn't been validated
+	size := min(l.Text.FontSize, maxFontSize)
+	text := l.Text.TextContent
+	if len(text) > maxTextLength {
+		text = text[:maxTextLength]
+	}
+	// Faces aren't safe for concurrent use, so each render gets its own.
+	// A DPI of 72 makes the font size equal to the pixel size used by clients
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    float64(size),
+		DPI:     72,
+		Hinting: font.HintingNone,
+	})
+	if err != nil {
+		slog.Error("error creating font face for text layer", "layer", l.Id(), "err", err)
+		return
+	}
+	defer face.Close()
+
+	// Positions are of the text's baseline, the same as canvas fillText
+	drawer := font.Drawer{
+		Dst:  dst,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(l.Text.X, l.Text.Y),
+	}
+	drawer.DrawString(text)
+}
@@ -20,6 +20,9 @@ func (*setPacket) PacketType() string {
 }
 
 func (packet *setPacket) Handle(layers *layer.Manager, users *user.Manager, sender user.Id) (user.OutgoingPacket, error) {
+	if err := packet.Text.validate(); err != nil {
+		return nil, err
+	}
 	textLayer, _, err := layer.GetOwnedOfType[*textLayer](layers, packet.LayerId, sender, "set contents of")
 	if err != nil {
 		return nil, err
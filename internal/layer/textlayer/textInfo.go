@@ -1,8 +1,29 @@
 package textlayer
 
+import (
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+)
+
+const (
+	// Larger fonts take too long and too much memory to rasterize
+	maxFontSize = 512
+	// In bytes
+	maxTextLength = 4096
+)
+
 type textInfo struct {
 	X           int    `json:"x"`
 	Y           int    `json:"y"`
 	FontSize    int    `json:"font_size"`
 	TextContent string `json:"text_content"`
 }
+
+func (t *textInfo) validate() error {
+	if t.FontSize <= 0 || t.FontSize > maxFontSize {
+		return errcode.Errorf(errcode.InvalidArgument, "font size %d isn't between 1 and %d", t.FontSize, maxFontSize)
+	}
+	if len(t.TextContent) > maxTextLength {
+		return errcode.Errorf(errcode.InvalidArgument, "text of %d bytes is longer than %d", len(t.TextContent), maxTextLength)
+	}
+	return nil
+}
@@ -1,10 +1,10 @@
 package textlayer
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
-	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
 
@@ -15,14 +15,14 @@ type textLayer struct {
 	Text textInfo
 }
 
-func newTextLayer(id layer.Id, owner user.Id) layer.Layer {
+func newTextLayer(id layer.Id, owner user.Id, width, height int) layer.Layer {
 	return &textLayer{
 		layer.LayerInfo{
 			LayerId:    id,
 			LayerOwner: owner,
 			LayerName:  fmt.Sprintf("Text Layer %d", id),
 		},
-		textInfo{canvas.Width / 2, canvas.Height / 2, 30, "Text"},
+		textInfo{width / 2, height / 2, 30, "Text"},
 	}
 }
 
@@ -35,3 +35,16 @@ func (l *textLayer) LayerType() layer.Type {
 func (l *textLayer) InitPacket() user.OutgoingPacket {
 	return &setPacket{l.Text, l.Id()}
 }
+
+func (l *textLayer) Clone() layer.Layer {
+	clone := *l
+	return &clone
+}
+
+func (l *textLayer) MarshalContents() ([]byte, error) {
+	return json.Marshal(l.Text)
+}
+
+func (l *textLayer) UnmarshalContents(data []byte) error {
+	return json.Unmarshal(data, &l.Text)
+}
@@ -0,0 +1,101 @@
+// Package ora reads and writes rooms as OpenRaster archives, which can be
+// opened as layered images in programs such as Krita and GIMP.
+//
+// Layers that aren't paint layers are rasterized so other programs can display
+// them, and additionally store their type and contents as attributes in the
+// whiteboard namespace so they can be restored when imported.
+package ora
+
+import (
+	"encoding/xml"
+	"math"
+)
+
+const (
+	mimetype = "image/openraster"
+
+	// Namespace for attributes only understood by the whiteboard
+	namespace = "https://github.com/turtlearmy/online-whiteboard"
+
+	stackPath     = "stack.xml"
+	mergedPath    = "mergedimage.png"
+	thumbnailPath = "Thumbnails/thumbnail.png"
+
+	// Thumbnails must be no larger than this in either dimension
+	thumbnailSize = 256
+)
+
+// Limits on what's read from an archive, since archives are uploaded by anyone
+const (
+	// Archives larger than this aren't read
+	MaxArchiveSize = 256 << 20
+	// Largest stack.xml that's read
+	maxStackSize = 4 << 20
+	// Largest layer image that's read, before decoding
+	maxEntrySize = 64 << 20
+	maxLayers    = 100
+	// Bytes of pixels decoded from every layer image together
+	maxPixelBytes = 1 << 30
+)
+
+// Written stack.xml contents
+type imageElem struct {
+	XMLName   xml.Name  `xml:"image"`
+	Version   string    `xml:"version,attr"`
+	Width     int       `xml:"w,attr"`
+	Height    int       `xml:"h,attr"`
+	Namespace string    `xml:"xmlns:whiteboard,attr"`
+	Stack     stackElem `xml:"stack"`
+}
+
+type stackElem struct {
+	Layers []layerElem `xml:"layer"`
+}
+
+type layerElem struct {
+	Name       string `xml:"name,attr"`
+	Src        string `xml:"src,attr"`
+	X          int    `xml:"x,attr"`
+	Y          int    `xml:"y,attr"`
+	Opacity    string `xml:"opacity,attr"`
+	Visibility string `xml:"visibility,attr"`
+	Type       string `xml:"whiteboard:type,attr,omitempty"`
+	Contents   string `xml:"whiteboard:contents,attr,omitempty"`
+}
+
+// Read stack.xml contents. Stacks can be nested, so layers and stacks are read
+// as the same element
+type readImage struct {
+	Width  int      `xml:"w,attr"`
+	Height int      `xml:"h,attr"`
+	Stack  readItem `xml:"stack"`
+}
+
+type readItem struct {
+	XMLName xml.Name
+	Name    string     `xml:"name,attr"`
+	Src     string     `xml:"src,attr"`
+	X       int        `xml:"x,attr"`
+	Y       int        `xml:"y,attr"`
+	Opacity *float64   `xml:"opacity,attr"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Items   []readItem `xml:",any"`
+}
+
+// Gets an attribute in the whiteboard namespace
+func (item *readItem) attr(local string) (string, bool) {
+	for _, a := range item.Attrs {
+		if a.Name.Space == namespace && a.Name.Local == local {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Clamped to between 0 and 1
+func (item *readItem) opacity() float64 {
+	if item.Opacity == nil || math.IsNaN(*item.Opacity) {
+		return 1
+	}
+	return math.Max(0, math.Min(*item.Opacity, 1))
+}
@@ -0,0 +1,184 @@
+package ora
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log/slog"
+	"path"
+
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+	"github.com/turtlearmy/online-whiteboard/internal/layer/paintlayer"
+)
+
+// Reads an archive into layers with the same size as the archive's image,
+// which can have at most maxArea pixels. Imported layers are unowned, since
+// user ids from the room they were exported from are meaningless in a new room
+func Read(r io.ReaderAt, size int64, maxArea int) (*layer.Manager, error) {
+	if size > MaxArchiveSize {
+		return nil, fmt.Errorf("archive is larger than %d bytes", MaxArchiveSize)
+	}
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	reader := &reader{archive: archive}
+
+	f, err := reader.open(stackPath, maxStackSize)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var stack readImage
+	if err := xml.NewDecoder(f).Decode(&stack); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", stackPath, err)
+	}
+
+	if !canvas.ValidSize(stack.Width, stack.Height) || stack.Width*stack.Height > maxArea {
+		return nil, fmt.Errorf("image size %dx%d is not supported", stack.Width, stack.Height)
+	}
+
+	reader.layers = layer.NewManager(stack.Width, stack.Height)
+	reader.width, reader.height = stack.Width, stack.Height
+	if err := reader.readStack(&stack.Stack, 0, 0, 1); err != nil {
+		return nil, err
+	}
+	return reader.layers, nil
+}
+
+type reader struct {
+	archive       *zip.Reader
+	layers        *layer.Manager
+	width, height int
+	// Bytes of pixels decoded so far
+	pixelBytes int
+}
+
+// Nested stacks are flattened into a single list of layers, keeping their order
+func (r *reader) readStack(stack *readItem, x, y int, opacity float64) error {
+	for i := range stack.Items {
+		item := &stack.Items[i]
+		switch item.XMLName.Local {
+		case "stack":
+			if err := r.readStack(item, x+item.X, y+item.Y, opacity*item.opacity()); err != nil {
+				return err
+			}
+		case "layer":
+			if r.layers.TotalCount() >= maxLayers {
+				return fmt.Errorf("archive has more than %d layers", maxLayers)
+			}
+			if err := r.readLayer(item, x+item.X, y+item.Y, opacity*item.opacity()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *reader) readLayer(item *readItem, x, y int, opacity float64) error {
+	// Restore layers that were exported with their contents. Layers with
+	// pixels are always read from their image, which is checked against the
+	// limits, like NewDocument only writes the contents of layers without them
+	if layerType, ok := item.attr("type"); ok {
+		contents, _ := item.attr("contents")
+		l, err := r.layers.CreateLayer(layer.Type(layerType), 0)
+		if _, hasPixels := l.(layer.ImageSetter); err == nil && hasPixels {
+			err = fmt.Errorf("%s layers are read from their image", layerType)
+		}
+		if err == nil {
+			err = l.UnmarshalContents([]byte(contents))
+		}
+		if err == nil {
+			l.SetName(item.Name)
+			r.layers.Add(l)
+			return nil
+		}
+		// Fall back to the layer's image
+		slog.Warn("error restoring layer from archive", "layer_type", layerType, "layer_name", item.Name, "err", err)
+	}
+
+	img, err := r.readImage(item.Src, x, y, opacity)
+	if err != nil {
+		return err
+	}
+	l, err := r.layers.CreateLayer(paintlayer.LAYER_TYPE, 0)
+	if err != nil {
+		return err
+	}
+	l.(layer.ImageSetter).SetImage(img)
+	if item.Name != "" {
+		l.SetName(item.Name)
+	}
+	r.layers.Add(l)
+	return nil
+}
+
+// Reads a layer's png, placed at its position on the canvas
+func (r *reader) readImage(src string, x, y int, opacity float64) (*image.NRGBA, error) {
+	// Layers entirely outside of the canvas are empty
+	if src == "" || x <= -r.width || x >= r.width || y <= -r.height || y >= r.height {
+		return &image.NRGBA{}, nil
+	}
+
+	// Check dimensions before decoding to avoid allocating huge images
+	f, err := r.open(src, maxEntrySize)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := png.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding '%s': %w", src, err)
+	}
+	if cfg.Width > r.width || cfg.Height > r.height {
+		return nil, fmt.Errorf("layer image '%s' is larger than the %dx%d canvas", src, r.width, r.height)
+	}
+	// The image is decoded and then copied onto the layer
+	r.pixelBytes += 2 * cfg.Width * cfg.Height * 4
+	if r.pixelBytes > maxPixelBytes {
+		return nil, fmt.Errorf("layer images are larger than %d bytes in total", maxPixelBytes)
+	}
+	if f, err = r.open(src, maxEntrySize); err != nil {
+		return nil, err
+	}
+	srcImg, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding '%s': %w", src, err)
+	}
+
+	dst := image.NewNRGBA(srcImg.Bounds().Sub(srcImg.Bounds().Min).Add(image.Pt(x, y)))
+	if opacity >= 1 {
+		draw.Draw(dst, dst.Bounds(), srcImg, srcImg.Bounds().Min, draw.Src)
+	} else {
+		mask := image.NewUniform(color.Alpha{uint8(opacity * 0xFF)})
+		draw.DrawMask(dst, dst.Bounds(), srcImg, srcImg.Bounds().Min, mask, image.Point{}, draw.Src)
+	}
+	return dst, nil
+}
+
+// Opens a file in the archive that's no larger than maxSize when
+// uncompressed. Reading a file fails if it's larger than its header says
+func (r *reader) open(name string, maxSize int64) (io.ReadCloser, error) {
+	// Archive paths are always relative to the root of the archive
+	f, err := r.archive.Open(path.Clean(name))
+	if err != nil {
+		return nil, fmt.Errorf("error opening '%s': %w", name, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error opening '%s': %w", name, err)
+	}
+	if info.Size() > maxSize {
+		f.Close()
+		return nil, fmt.Errorf("'%s' is larger than %d bytes", name, maxSize)
+	}
+	return f, nil
+}
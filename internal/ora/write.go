@@ -0,0 +1,138 @@
+package ora
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Copy of a room's layers. Documents are created from a copy made on the
+// room's goroutine, and are rasterized and encoded elsewhere
+type Document struct {
+	width, height int
+	// Stored in order of top to bottom, the same as in stack.xml
+	layers []docLayer
+}
+
+type docLayer struct {
+	name  string
+	layer layer.Layer
+	// Only set for layers that can't be fully restored from their image
+	layerType layer.Type
+	contents  []byte
+}
+
+// layers must not be used by anything else, such as a copy from Manager.Clone
+func NewDocument(layers *layer.Manager) (*Document, error) {
+	doc := &Document{layers.Width, layers.Height, make([]docLayer, 0, len(layers.Layers))}
+	for _, l := range layers.Layers {
+		d := docLayer{name: l.Name(), layer: l}
+		if _, ok := l.(layer.ImageSetter); !ok {
+			contents, err := l.MarshalContents()
+			if err != nil {
+				return nil, fmt.Errorf("error saving contents of layer %d: %w", l.Id(), err)
+			}
+			d.layerType = l.LayerType()
+			d.contents = contents
+		}
+		doc.layers = append(doc.layers, d)
+	}
+	return doc, nil
+}
+
+func (doc *Document) thumbnail(merged image.Image) *image.RGBA {
+	width, height := doc.width, doc.height
+	if width > height {
+		width, height = thumbnailSize, height*thumbnailSize/width
+	} else {
+		width, height = width*thumbnailSize/height, thumbnailSize
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.ApproxBiLinear.Scale(thumbnail, thumbnail.Bounds(), merged, merged.Bounds(), xdraw.Src, nil)
+	return thumbnail
+}
+
+func (doc *Document) Write(w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	// The mimetype must be the first file and uncompressed so the archive can
+	// be identified by its first bytes
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, mimetype); err != nil {
+		return err
+	}
+
+	// Layers are rasterized one at a time from the bottom, reusing the same
+	// image, so only a few images the size of the canvas are allocated
+	stack := imageElem{Version: "0.0.5", Width: doc.width, Height: doc.height, Namespace: namespace}
+	stack.Stack.Layers = make([]layerElem, len(doc.layers))
+	img := image.NewNRGBA(image.Rect(0, 0, doc.width, doc.height))
+	merged := image.NewRGBA(img.Bounds())
+	for i := len(doc.layers) - 1; i >= 0; i-- {
+		l := doc.layers[i]
+		clear(img.Pix)
+		if r, ok := l.layer.(layer.Rasterizer); ok {
+			r.Rasterize(img)
+		}
+		src := fmt.Sprintf("data/layer%d.png", i)
+		if err := writePNG(archive, src, img); err != nil {
+			return err
+		}
+		draw.Draw(merged, merged.Bounds(), img, image.Point{}, draw.Over)
+		stack.Stack.Layers[i] = layerElem{
+			Name:       l.name,
+			Src:        src,
+			Opacity:    "1.0",
+			Visibility: "visible",
+			Type:       string(l.layerType),
+			Contents:   string(l.contents),
+		}
+	}
+
+	f, err = archive.Create(stackPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(f)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(stack); err != nil {
+		return err
+	}
+
+	if err := writePNG(archive, mergedPath, merged); err != nil {
+		return err
+	}
+	if err := writePNG(archive, thumbnailPath, doc.thumbnail(merged)); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writePNG(archive *zip.Writer, name string, img image.Image) error {
+	// PNGs are already compressed
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	return png.Encode(f, img)
+}
@@ -0,0 +1,71 @@
+// Package ratelimit limits how often things happen with token buckets, which
+// allow bursts up to their size and refill at a steady rate
+package ratelimit
+
+import "time"
+
+// How fast a bucket refills and how much it holds. The zero Rate doesn't limit
+// anything
+type Rate struct {
+	PerSecond float64
+	Burst     float64
+}
+
+func (r Rate) Unlimited() bool {
+	return r.PerSecond <= 0
+}
+
+// Not safe for concurrent use
+type Bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// Buckets start full
+func NewBucket(rate Rate) *Bucket {
+	return &Bucket{rate, rate.Burst, time.Now()}
+}
+
+// Takes n tokens if the bucket has enough. Always succeeds for unlimited
+// buckets
+func (b *Bucket) Take(n float64) bool {
+	if b == nil || b.rate.Unlimited() {
+		return true
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.PerSecond
+	if b.tokens > b.rate.Burst {
+		b.tokens = b.rate.Burst
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Buckets for each key, created the first time they're used
+type Buckets[K comparable] struct {
+	rates   map[K]Rate
+	buckets map[K]*Bucket
+}
+
+func NewBuckets[K comparable](rates map[K]Rate) *Buckets[K] {
+	return &Buckets[K]{rates, map[K]*Bucket{}}
+}
+
+// Keys without a rate aren't limited
+func (b *Buckets[K]) Take(key K, n float64) bool {
+	rate, ok := b.rates[key]
+	if !ok {
+		return true
+	}
+	bucket := b.buckets[key]
+	if bucket == nil {
+		bucket = NewBucket(rate)
+		b.buckets[key] = bucket
+	}
+	return bucket.Take(n)
+}
@@ -0,0 +1,328 @@
+package room
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/turtlearmy/online-whiteboard/internal/adminapi"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	layerpackets "github.com/turtlearmy/online-whiteboard/internal/layer/packets"
+	"github.com/turtlearmy/online-whiteboard/internal/store"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+// Sent when an administrator removes a connection or closes its room. Clients
+// shouldn't reconnect
+const closeRemoved = 4001
+
+// Returned by administration of rooms that aren't loaded
+var ErrNotLoaded = errcode.New(errcode.NotFound, "room isn't loaded")
+
+// Every loaded room, in order of name
+func (registry *RoomRegistry) LoadedRooms() []*Room {
+	registry.mutex.Lock()
+	rooms := make([]*Room, 0, len(registry.rooms))
+	for _, room := range registry.rooms {
+		rooms = append(rooms, room)
+	}
+	registry.mutex.Unlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	return rooms
+}
+
+// Summaries of loaded rooms and of rooms that are only in the store, sorted by
+// name. Stored rooms aren't loaded to summarize them
+func (registry *RoomRegistry) Summaries() ([]adminapi.Summary, error) {
+	list := []adminapi.Summary{}
+	loaded := map[string]bool{}
+	for _, room := range registry.LoadedRooms() {
+		// Rooms unloaded since they were listed are in the store
+		if summary, err := room.Summary(); err == nil {
+			list = append(list, summary)
+			loaded[UrlName(room.name)] = true
+		}
+	}
+	if registry.store != nil {
+		keys, err := registry.store.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !loaded[key] {
+				list = append(list, adminapi.Summary{Name: key})
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return UrlName(list[i].Name) < UrlName(list[j].Name) })
+	return list, nil
+}
+
+func (registry *RoomRegistry) loaded(name string) *Room {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.rooms[UrlName(name)]
+}
+
+// Saves a loaded room, closes its connections and unloads it. Rooms that can't
+// be saved are left open
+func (registry *RoomRegistry) CloseRoom(name string) error {
+	room := registry.loaded(name)
+	if room == nil {
+		return ErrNotLoaded
+	}
+	var err error
+	if doErr := room.do(func() { err = room.close() }); errors.Is(doErr, ErrClosed) {
+		return ErrNotLoaded
+	} else if doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+// Closes a room without saving it and removes it from the store
+func (registry *RoomRegistry) DeleteRoom(name string) error {
+	key := UrlName(name)
+	for {
+		registry.mutex.Lock()
+		for registry.waitPending(key) {
+		}
+		room := registry.rooms[key]
+		if room == nil {
+			// Claimed so the room isn't restored while it's being deleted
+			release := registry.claim(key)
+			registry.mutex.Unlock()
+			err := registry.deleteStored(key)
+			registry.mutex.Lock()
+			release()
+			registry.mutex.Unlock()
+			return err
+		}
+		registry.mutex.Unlock()
+
+		var err error
+		if doErr := room.do(func() { err = room.delete("room deleted by an administrator") }); doErr == nil {
+			return err
+		} else if !errors.Is(doErr, ErrClosed) {
+			return doErr
+		}
+		// The room was unloaded first, so it's only in the store now
+	}
+}
+
+// Must be called with the room claimed
+func (registry *RoomRegistry) deleteStored(key string) error {
+	if registry.store == nil {
+		return errcode.New(errcode.NotFound, "room not found")
+	}
+	if _, err := registry.store.Load(key); errors.Is(err, store.ErrNotFound) {
+		return errcode.Wrap(errcode.NotFound, err)
+	}
+	return registry.store.Delete(key)
+}
+
+// Replaces a room with a snapshot from Room.Snapshot, which may be of a
+// different room. Connections to the room being replaced are closed
+func (registry *RoomRegistry) RestoreRoom(name string, saved *store.Room) error {
+	if !ValidName(name) {
+		return errcode.Errorf(errcode.InvalidArgument, "invalid room name '%s'", name)
+	}
+	if width, height := saved.Layers.Width, saved.Layers.Height; width != 0 && !registry.limits.ValidCanvasSize(width, height) {
+		return errcode.Errorf(errcode.InvalidArgument, "canvas size %dx%d is too large", width, height)
+	}
+	if saved.Backpressure != nil {
+		if err := saved.Backpressure.Validate(); err != nil {
+			return errcode.Wrap(errcode.InvalidArgument, err)
+		}
+	}
+	key := UrlName(name)
+	snapshot := *saved
+	snapshot.Name = name
+	for {
+		registry.mutex.Lock()
+		for registry.waitPending(key) {
+		}
+		if registry.closed {
+			registry.mutex.Unlock()
+			return ErrClosed
+		}
+		existing := registry.rooms[key]
+		if existing == nil {
+			if registry.full() {
+				registry.mutex.Unlock()
+				return ErrTooManyRooms
+			}
+			release := registry.claim(key)
+			registry.mutex.Unlock()
+			room, err := restoreRoom(registry, &snapshot)
+			registry.mutex.Lock()
+			release()
+			if err != nil {
+				registry.mutex.Unlock()
+				return errcode.Wrap(errcode.InvalidArgument, err)
+			}
+			if registry.closed {
+				registry.mutex.Unlock()
+				go room.shutdown()
+				return ErrClosed
+			}
+			registry.rooms[key] = room
+			registry.mutex.Unlock()
+
+			var saveErr error
+			if err := room.do(func() {
+				room.dirty = true
+				saveErr = room.save()
+			}); err != nil {
+				return err
+			}
+			return saveErr
+		}
+		registry.mutex.Unlock()
+
+		// Restored rooms are created in the loop, since another room could
+		// be created while the existing one stops
+		var err error
+		if doErr := existing.do(func() { err = existing.delete("room replaced by an administrator") }); doErr == nil && err != nil {
+			return err
+		} else if doErr != nil && !errors.Is(doErr, ErrClosed) {
+			return doErr
+		}
+	}
+}
+
+func (room *Room) close() error {
+	if err := room.save(); err != nil {
+		return err
+	}
+	room.users.CloseAll(closeRemoved, "room closed by an administrator")
+	room.unload()
+	return nil
+}
+
+// Closes every connection with reason and stops the room without saving it
+func (room *Room) delete(reason string) error {
+	room.users.CloseAll(closeRemoved, reason)
+	// Removed from the store before the registry, so a request for the room
+	// in between gets this room and waits for it to stop instead of
+	// restoring it
+	var err error
+	if room.registry.store != nil {
+		err = room.registry.store.Delete(UrlName(room.name))
+	}
+	room.registry.unload(room)
+	room.open = false
+	if err == nil {
+		room.logger.Info(reason)
+	}
+	return err
+}
+
+// The room in the form it's stored in, which can be restored with
+// RestoreRoom
+func (room *Room) Snapshot() (saved *store.Room, err error) {
+	if doErr := room.do(func() { saved, err = room.snapshot() }); doErr != nil {
+		return nil, doErr
+	}
+	return
+}
+
+func (room *Room) summary() adminapi.Summary {
+	return adminapi.Summary{
+		Name:        room.name,
+		Loaded:      true,
+		Public:      room.public,
+		Connections: room.users.ConnectionCount(),
+		OnlineUsers: len(room.users.OnlineUsers()),
+		LayerCount:  room.layers.TotalCount(),
+	}
+}
+
+func (room *Room) Summary() (s adminapi.Summary, err error) {
+	err = room.do(func() { s = room.summary() })
+	return
+}
+
+func (room *Room) Details() (d adminapi.Details, err error) {
+	err = room.do(func() {
+		d = adminapi.Details{
+			Summary: room.summary(),
+			Owner:   uint(room.owner),
+			Width:   room.layers.Width,
+			Height:  room.layers.Height,
+			Layers:  []adminapi.LayerDetails{},
+			Users:   []adminapi.UserDetails{},
+		}
+		for height, l := range room.layers.Layers {
+			d.Layers = append(d.Layers, adminapi.LayerDetails{
+				Id:     uint(l.Id()),
+				Type:   string(l.LayerType()),
+				Name:   l.Name(),
+				Owner:  uint(l.Owner()),
+				Height: height,
+			})
+		}
+		connections := map[user.Id][]uint{}
+		for _, c := range room.users.Connections() {
+			connections[c.User] = append(connections[c.User], c.Id())
+		}
+		for _, u := range room.users.Users() {
+			d.Users = append(d.Users, adminapi.UserDetails{Id: uint(u), Name: room.users.Name(u), Connections: connections[u]})
+		}
+	})
+	return
+}
+
+// Closes a connection with a close frame telling it not to reconnect
+func (room *Room) Kick(conn uint) error {
+	var err error
+	if doErr := room.do(func() {
+		c, ok := room.users.Connection(conn)
+		if !ok {
+			err = errcode.Errorf(errcode.NotFound, "connection %d not found", conn)
+			return
+		}
+		room.connLogger(c).Info("connection kicked by an administrator")
+		c.Close(closeRemoved, "removed by an administrator")
+		room.removeConnection(c)
+	}); doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+// Gives a layer to another user, or to nobody if owner is 0
+func (room *Room) SetLayerOwner(id layer.Id, owner user.Id) error {
+	var err error
+	if doErr := room.do(func() {
+		l, _ := room.layers.Get(id)
+		if l == nil {
+			err = errcode.Errorf(errcode.NotFound, "layer %d not found", id)
+			return
+		}
+		if owner != 0 && !room.users.Known(owner) {
+			err = errcode.Errorf(errcode.NotFound, "user %d not found", owner)
+			return
+		}
+		l.SetOwner(owner)
+		room.dirty = true
+		err = room.users.SendToAll(layerpackets.NewSetOwnerPacket(id, owner))
+	}); doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+// Sends a notice from an administrator to every connection
+func (room *Room) Notice(message string) error {
+	if message == "" {
+		return errcode.New(errcode.InvalidArgument, "notice message is empty")
+	}
+	var err error
+	if doErr := room.do(func() {
+		err = room.users.SendToAll(&noticePacket{notice_system, message})
+	}); doErr != nil {
+		return doErr
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+	"github.com/turtlearmy/online-whiteboard/internal/ratelimit"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+// Limits on what clients can send. Connections that exceed them are sent a
+// notice and closed
+type Limits struct {
+	// Size in bytes of the largest message a connection can send
+	MaxMessageSize int64
+	// Most pixels a room's canvas can have. Exports allocate images the size
+	// of the canvas, so this bounds their memory use
+	MaxCanvasArea int
+	// Most rooms loaded at once. Rooms beyond it aren't created or restored
+	// until others are unloaded. Not limited if 0
+	MaxLoadedRooms int
+	// Most connections to each room. Not limited if 0
+	MaxRoomConnections int
+	// Packets and bytes received on each connection
+	ConnectionPackets, ConnectionBytes ratelimit.Rate
+	// Packets and bytes received from each user over all their connections
+	UserPackets, UserBytes ratelimit.Rate
+	// Packets of each type received on each connection
+	PacketTypes map[string]ratelimit.Rate
+}
+
+// Whether a room's canvas can be this size
+func (limits Limits) ValidCanvasSize(width, height int) bool {
+	return canvas.ValidSize(width, height) && width*height <= limits.MaxCanvasArea
+}
+
+// Used by a connection's reader
+type connectionLimiter struct {
+	packets, bytes *ratelimit.Bucket
+	types          *ratelimit.Buckets[string]
+}
+
+func newConnectionLimiter(limits Limits) *connectionLimiter {
+	return &connectionLimiter{
+		ratelimit.NewBucket(limits.ConnectionPackets),
+		ratelimit.NewBucket(limits.ConnectionBytes),
+		ratelimit.NewBuckets(limits.PacketTypes),
+	}
+}
+
+// Returns an error describing the limit if the packet exceeds one
+func (l *connectionLimiter) allow(packetType string, size int) error {
+	if !l.packets.Take(1) {
+		return errors.New("too many packets")
+	}
+	if !l.bytes.Take(float64(size)) {
+		return errors.New("too much data")
+	}
+	if !l.types.Take(packetType, 1) {
+		return fmt.Errorf("too many %s packets", packetType)
+	}
+	return nil
+}
+
+// Used by the room for each user
+type userLimiter struct {
+	packets, bytes *ratelimit.Bucket
+}
+
+func (room *Room) allowUser(u user.Id, size int) error {
+	l := room.userLimiters[u]
+	if l == nil {
+		limits := room.registry.limits
+		l = &userLimiter{ratelimit.NewBucket(limits.UserPackets), ratelimit.NewBucket(limits.UserBytes)}
+		room.userLimiters[u] = l
+	}
+	if !l.packets.Take(1) {
+		return errors.New("too many packets from user")
+	}
+	if !l.bytes.Take(float64(size)) {
+		return errors.New("too much data from user")
+	}
+	return nil
+}
+
+// Tells a connection which limit it exceeded and closes it
+func (room *Room) closeLimited(c user.Connection, err error) {
+	logger := room.connLogger(c)
+	logger.Warn("closing connection for exceeding limits", "err", err)
+	if err := c.Send(&noticePacket{notice_rate_limited, err.Error()}); err != nil {
+		logger.Error("error sending notice", "err", err)
+	}
+	c.Close(websocket.ClosePolicyViolation, "limit exceeded")
+}
@@ -1,11 +1,26 @@
 package room
 
 import (
-	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"time"
+
+	"github.com/turtlearmy/online-whiteboard/internal/c2s"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
 
 type message struct {
-	Packet layer.Handler
+	Packet c2s.Packet
 	Sender user.Connection
+	// Set if the packet couldn't be decoded, so the error can be reported to
+	// the sender from the room's goroutine
+	decodeErr error
+	// Size of the message in bytes, used for rate limiting
+	size int
+	// When the message was read from the websocket
+	received time.Time
+}
+
+// Implemented by packets that change the room itself instead of just its
+// layers or users. Used instead of layer.Handler when handled by a room
+type roomHandler interface {
+	handleRoom(room *Room, sender user.Connection) (user.OutgoingPacket, error)
 }
@@ -0,0 +1,119 @@
+package room
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+)
+
+// How often each room refreshes the stats reported in its metrics
+const statsInterval = 5 * time.Second
+
+var (
+	packetsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whiteboard_packets_handled_total",
+		Help: "Packets applied, by type.",
+	}, []string{"type"})
+	packetsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whiteboard_packets_rejected_total",
+		Help: "Packets that couldn't be decoded, failed or exceeded a rate limit, by type.",
+	}, []string{"type"})
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "whiteboard_handler_duration_seconds",
+		Help:    "Time taken to apply packets, by type.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"type"})
+	// Grows when rooms' goroutines can't keep up with their packets
+	messageWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "whiteboard_message_wait_seconds",
+		Help:    "Time packets wait to be handled after they're received.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	handlerPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whiteboard_handler_panics_total",
+		Help: "Panics recovered from while handling packets and running tasks.",
+	})
+	receivedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whiteboard_received_bytes_total",
+		Help: "Bytes of websocket messages received.",
+	})
+	sentBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whiteboard_sent_bytes_total",
+		Help: "Bytes of websocket messages sent.",
+	})
+)
+
+// Packets of unknown types are counted together, so clients can't create
+// metrics
+func packetLabel(packetType string) string {
+	if c2s.Registered(packetType) {
+		return packetType
+	}
+	return "unknown"
+}
+
+// Read from other goroutines without waiting for the room's
+type roomStats struct {
+	connections  int
+	onlineUsers  int
+	queuedFrames int
+	queuedBytes  int
+	layerBytes   int
+}
+
+func (room *Room) updateStats() {
+	frames, bytes := room.users.Queued()
+	room.stats.Store(roomStats{
+		connections:  room.users.ConnectionCount(),
+		onlineUsers:  len(room.users.OnlineUsers()),
+		queuedFrames: frames,
+		queuedBytes:  bytes,
+		layerBytes:   room.layers.MemoryUsage(),
+	})
+}
+
+func (room *Room) loadStats() roomStats {
+	stats, _ := room.stats.Load().(roomStats)
+	return stats
+}
+
+var roomsLoaded = prometheus.NewDesc("whiteboard_rooms_loaded", "Rooms loaded in memory.", nil, nil)
+
+var roomGauges = []struct {
+	desc  *prometheus.Desc
+	value func(room *Room, stats roomStats) int
+}{
+	{roomGauge("whiteboard_room_connections", "Open connections to each room."), func(_ *Room, s roomStats) int { return s.connections }},
+	{roomGauge("whiteboard_room_online_users", "Users with a connection to each room."), func(_ *Room, s roomStats) int { return s.onlineUsers }},
+	{roomGauge("whiteboard_room_queued_frames", "Frames waiting to be written to each room's connections."), func(_ *Room, s roomStats) int { return s.queuedFrames }},
+	{roomGauge("whiteboard_room_queued_bytes", "Bytes waiting to be written to each room's connections."), func(_ *Room, s roomStats) int { return s.queuedBytes }},
+	{roomGauge("whiteboard_room_layer_bytes", "Memory used by the contents of each room's layers."), func(_ *Room, s roomStats) int { return s.layerBytes }},
+	// Read directly, since rooms that fall behind don't refresh their stats
+	{roomGauge("whiteboard_room_pending_messages", "Packets received by each room that haven't been handled yet."), func(r *Room, _ roomStats) int { return len(r.incomingMessages) }},
+}
+
+func roomGauge(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(name, help, []string{"room"}, nil)
+}
+
+// Implements prometheus.Collector
+func (registry *RoomRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsLoaded
+	for _, gauge := range roomGauges {
+		ch <- gauge.desc
+	}
+}
+
+// Collects the number of loaded rooms and the gauges of each room
+func (registry *RoomRegistry) Collect(ch chan<- prometheus.Metric) {
+	rooms := registry.LoadedRooms()
+	ch <- prometheus.MustNewConstMetric(roomsLoaded, prometheus.GaugeValue, float64(len(rooms)))
+	for _, room := range rooms {
+		stats := room.loadStats()
+		for _, gauge := range roomGauges {
+			ch <- prometheus.MustNewConstMetric(gauge.desc, prometheus.GaugeValue, float64(gauge.value(room, stats)), room.name)
+		}
+	}
+}
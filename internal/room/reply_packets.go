@@ -0,0 +1,65 @@
+package room
+
+import (
+	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+)
+
+const (
+	packet_type_ack    = "ack"
+	packet_type_error  = "error"
+	packet_type_notice = "notice"
+)
+
+// Codes of notice packets
+const (
+	notice_rate_limited = "rate_limited"
+	// Sent by an administrator to everyone in a room
+	notice_system = "system"
+)
+
+// Tells the sender of a request that it was applied. Only sent for packets
+// with a request id
+type ackPacket struct {
+	RequestId c2s.RequestId `json:"request_id"`
+}
+
+func (*ackPacket) PacketType() string {
+	return packet_type_ack
+}
+
+// Tells the sender of a packet that it was rejected, so it can undo or resync
+// whatever the packet changed
+type errorPacket struct {
+	RequestId c2s.RequestId `json:"request_id,omitempty"`
+	// Type of the rejected packet, if it could be decoded
+	Type    string       `json:"packet_type,omitempty"`
+	Code    errcode.Code `json:"code"`
+	Message string       `json:"message"`
+}
+
+func newErrorPacket(packet c2s.Packet, err error) *errorPacket {
+	code := errcode.CodeOf(err)
+	message := err.Error()
+	// Internal errors aren't the client's fault, so their details aren't useful
+	// to it
+	if code == errcode.Internal {
+		message = "internal server error"
+	}
+	return &errorPacket{packet.RequestId, packet.Type, code, message}
+}
+
+func (*errorPacket) PacketType() string {
+	return packet_type_error
+}
+
+// Tells a connection about something other than a packet it sent, such as
+// why it's about to be closed
+type noticePacket struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (*noticePacket) PacketType() string {
+	return packet_type_notice
+}
@@ -0,0 +1,39 @@
+package room
+
+import (
+	"errors"
+
+	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+const packet_type_resize_room = "resize_room"
+
+// Crops or extends every layer in the room. Only the room's owner can resize it
+type resizePacket struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+var _ = c2s.Register(packet_type_resize_room, func() layer.Handler { return &resizePacket{} })
+
+func (*resizePacket) Handle(*layer.Manager, *user.Manager, user.Id) (user.OutgoingPacket, error) {
+	return nil, errors.New("resize packets must be handled by a room")
+}
+
+func (packet *resizePacket) handleRoom(room *Room, sender user.Connection) (user.OutgoingPacket, error) {
+	if sender.User != room.owner {
+		return nil, errcode.Errorf(errcode.PermissionDenied, "user %d attempted to resize room owned by user %d", sender.User, room.owner)
+	}
+	if !room.registry.limits.ValidCanvasSize(packet.Width, packet.Height) {
+		return nil, errcode.Errorf(errcode.InvalidArgument, "user %d attempted to resize room to invalid size %dx%d", sender.User, packet.Width, packet.Height)
+	}
+	room.layers.Resize(packet.Width, packet.Height)
+	// Clients resize their layers when they receive the new room info
+	if err := room.users.SendToAll(room.infoPacket()); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
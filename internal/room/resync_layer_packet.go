@@ -0,0 +1,42 @@
+package room
+
+import (
+	"errors"
+
+	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	layerpackets "github.com/turtlearmy/online-whiteboard/internal/layer/packets"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+const packet_type_resync_layer = "resync_layer"
+
+// Requests the current state of a layer, e.g. after a change to it was
+// rejected. The layer is deleted and recreated for only the sender's
+// connection, or just deleted if it no longer exists
+type resyncLayerPacket struct {
+	Layer layer.Id `json:"layer"`
+}
+
+var _ = c2s.Register(packet_type_resync_layer, func() layer.Handler { return &resyncLayerPacket{} })
+
+func (*resyncLayerPacket) Handle(*layer.Manager, *user.Manager, user.Id) (user.OutgoingPacket, error) {
+	return nil, errors.New("resync layer packets must be handled by a room")
+}
+
+func (packet *resyncLayerPacket) handleRoom(room *Room, sender user.Connection) (user.OutgoingPacket, error) {
+	if err := sender.Send(layerpackets.NewS2CDeletePacket(packet.Layer)); err != nil {
+		return nil, err
+	}
+	l, height := room.layers.Get(packet.Layer)
+	if l == nil {
+		return nil, nil
+	}
+	if err := sender.Send(layerpackets.NewS2CCreatePacket(l, height)); err != nil {
+		return nil, err
+	}
+	if err := sender.Send(l.InitPacket()); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -1,43 +1,161 @@
 package room
 
 import (
-	"log"
+	"context"
+	"errors"
+	"image"
+	"log/slog"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
 	layerpackets "github.com/turtlearmy/online-whiteboard/internal/layer/packets"
 	"github.com/turtlearmy/online-whiteboard/internal/layer/paintlayer"
 	_ "github.com/turtlearmy/online-whiteboard/internal/layer/textlayer" // Needs to be imported to register layer and its packet
+	"github.com/turtlearmy/online-whiteboard/internal/ora"
+	"github.com/turtlearmy/online-whiteboard/internal/store"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
 
+// How often rooms with unsaved changes are written to the store
+const autosaveInterval = time.Minute
+
+// Rooms without connections are unloaded after this long, so clients that
+// briefly lose their connection can still resume it
+const unloadDelay = time.Minute
+
+// How long to wait for a close frame to be written
+const closeTimeout = time.Second
+
+const (
+	// Connections are pinged this often to check they're still alive
+	pingInterval = 30 * time.Second
+	// Connections that send nothing, not even a pong, for this long are dead
+	readTimeout = 2 * pingInterval
+	// Connections that can't be written to for this long are dead
+	writeTimeout = 10 * time.Second
+	// Connections that send no packets for this long are closed with
+	// closeIdle. Pongs don't count, so this closes tabs left open but unused
+	idleTimeout = time.Hour
+)
+
+// Sent when closing an idle connection. Clients shouldn't reconnect until
+// they're used again
+const closeIdle = 4000
+
+// Returned when using a room after it's unloaded
+var ErrClosed = errors.New("room is closed")
+
+// Returned when a room can't be created or restored because
+// Limits.MaxLoadedRooms are already loaded
+var ErrTooManyRooms = errors.New("too many rooms are loaded")
+
+// Returned when a room already has Limits.MaxRoomConnections
+var ErrRoomFull = errors.New("room is full")
+
+// Returned when exporting a room whose canvas is larger than the limit, which
+// can happen if it was saved before the limit was lowered
+var ErrTooLarge = errcode.New(errcode.InvalidArgument, "canvas is too large to export")
+
 type Room struct {
+	registry *RoomRegistry
+
 	name   string
 	public bool
+	// The user who created the room. Only the owner can resize the room
+	owner user.Id
 
 	incomingMessages chan *message
 	connRequests     chan user.ConnectionRequest
 	closeConns       chan user.Connection
+	failedWrites     chan failedWrite
+	// Functions that need to access room state from outside the room's
+	// goroutine
+	tasks chan func()
 
 	layers *layer.Manager
 	users  *user.Manager
+	// What happens to connections that fall behind
+	backpressure user.Backpressure
+	// Rate limits of each user that has sent packets
+	userLimiters map[user.Id]*userLimiter
 
 	open bool
+	// Closed once the room's goroutine has stopped
+	done chan struct{}
+	// Whether the room has changed since it was last saved
+	dirty bool
+	// When the last connection was removed
+	emptySince time.Time
+	// Adds the room's name to every record
+	logger *slog.Logger
+
+	// Kept up to date by the room's goroutine so it can be read from others
+	onlineUserCount int32
+	connectionCount int32
+	stats           atomic.Value
+}
+
+// A write to a connection's websocket that failed
+type failedWrite struct {
+	conn user.Connection
+	err  error
 }
 
-func newRoom(name string, public bool) *Room {
+func newRoom(registry *RoomRegistry, name string, settings Settings) *Room {
+	return startRoom(registry, name, settings.Public, 0, settings.Backpressure, layer.NewManager(settings.Width, settings.Height), user.NewManager())
+}
+
+// Imported rooms start with unsaved changes, since they've never been stored
+func importRoom(registry *RoomRegistry, name string, public bool, layers *layer.Manager) *Room {
+	room := startRoom(registry, name, public, 0, user.DefaultBackpressure(), layers, user.NewManager())
+	room.dirty = true
+	return room
+}
+
+func restoreRoom(registry *RoomRegistry, saved *store.Room) (*Room, error) {
+	layers, err := layer.RestoreManager(saved.Layers)
+	if err != nil {
+		return nil, err
+	}
+	backpressure := user.DefaultBackpressure()
+	if saved.Backpressure != nil {
+		backpressure = *saved.Backpressure
+	}
+	return startRoom(registry, saved.Name, saved.Public, saved.Owner, backpressure, layers, user.RestoreManager(saved.Users)), nil
+}
+
+func startRoom(registry *RoomRegistry, name string, public bool, owner user.Id, backpressure user.Backpressure, layers *layer.Manager, users *user.Manager) *Room {
+	users.SetBackpressure(backpressure)
 	room := &Room{
-		name,
-		public,
-		make(chan *message, 256),
-		make(chan user.ConnectionRequest, 8),
-		make(chan user.Connection, 8),
-		&layer.Manager{},
-		user.NewManager(),
-		true,
+		registry:         registry,
+		name:             name,
+		public:           public,
+		owner:            owner,
+		incomingMessages: make(chan *message, 256),
+		// Unbuffered so a request is either taken by the room or sees that
+		// the room has closed
+		connRequests: make(chan user.ConnectionRequest),
+		closeConns:   make(chan user.Connection, 8),
+		failedWrites: make(chan failedWrite, 8),
+		tasks:        make(chan func()),
+		layers:       layers,
+		users:        users,
+		backpressure: backpressure,
+		userLimiters: map[user.Id]*userLimiter{},
+		open:         true,
+		done:         make(chan struct{}),
+		emptySince:   time.Now(),
+		logger:       slog.Default().With("room", name),
 	}
 
 	go room.handleEvents()
@@ -49,64 +167,297 @@ func (room *Room) Name() string {
 	return room.name
 }
 
+// Logger for records about a connection
+func (room *Room) connLogger(c user.Connection) *slog.Logger {
+	return room.logger.With("user", c.User, "conn", c.Id())
+}
+
+// Logger for records about a message and its sender
+func (room *Room) messageLogger(msg *message) *slog.Logger {
+	return room.connLogger(msg.Sender).With("packet_type", msg.Packet.Type)
+}
+
+func (room *Room) OnlineUserCount() int {
+	return int(atomic.LoadInt32(&room.onlineUserCount))
+}
+
+// Runs task on the room's goroutine and waits for it to finish. Returns
+// ErrClosed without running task if the room has been unloaded, or an internal
+// error if task panics
+func (room *Room) do(task func()) error {
+	return room.doContext(context.Background(), task)
+}
+
+// Like do, but stops waiting once ctx is done. The task may still run after
+// that
+func (room *Room) doContext(ctx context.Context, task func()) error {
+	// Buffered so the room isn't held up if the caller stopped waiting
+	done := make(chan error, 1)
+	select {
+	case room.tasks <- func() { done <- room.runTask(task) }:
+	case <-room.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Panics are recovered from and returned as internal errors, so a bad task
+// can't stop the room
+func (room *Room) runTask(task func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			handlerPanics.Inc()
+			room.logger.Error("panic running task", "panic", r, "stack", string(debug.Stack()))
+			err = errcode.Errorf(errcode.Internal, "panic running task: %v", r)
+		}
+	}()
+	task()
+	return nil
+}
+
+// Copies the room's layers so they can be exported without holding up the
+// room's goroutine
+func (room *Room) cloneLayers() (layers *layer.Manager, err error) {
+	if doErr := room.do(func() {
+		if !room.registry.limits.ValidCanvasSize(room.layers.Width, room.layers.Height) {
+			err = ErrTooLarge
+			return
+		}
+		layers = room.layers.Clone()
+	}); doErr != nil {
+		return nil, doErr
+	}
+	return
+}
+
+// Composites all layers into a single image
+func (room *Room) Flatten() (*image.RGBA, error) {
+	layers, err := room.cloneLayers()
+	if err != nil {
+		return nil, err
+	}
+	return layers.Flatten(), nil
+}
+
+// Copies all layers into a document that can be written as an OpenRaster
+// archive
+func (room *Room) OpenRaster() (*ora.Document, error) {
+	layers, err := room.cloneLayers()
+	if err != nil {
+		return nil, err
+	}
+	return ora.NewDocument(layers)
+}
+
 func (room *Room) WsHandler(writer http.ResponseWriter, req *http.Request, session user.Session) {
 	err := room.addConnection(writer, req, session)
 	if err != nil {
-		log.Printf("error adding websocket connection: %v\n", err)
+		room.logger.Info("error adding websocket connection", "err", err)
 		return
 	}
 }
 
+// Whether the room has as many connections as it can have
+func (room *Room) full() bool {
+	limit := room.registry.limits.MaxRoomConnections
+	return limit > 0 && int(atomic.LoadInt32(&room.connectionCount)) >= limit
+}
+
 func (room *Room) addConnection(writer http.ResponseWriter, req *http.Request, session user.Session) error {
-	ws, err := wsupgrader.Upgrade(writer, req, nil)
+	// Checked again by the room's goroutine, since connections may be added
+	// meanwhile
+	if room.full() {
+		http.Error(writer, ErrRoomFull.Error(), http.StatusServiceUnavailable)
+		return ErrRoomFull
+	}
+	ws, err := room.registry.upgrader.Upgrade(writer, req, nil)
 	if err != nil {
 		return err
 	}
 
-	outgoing := make(chan []byte, 256)
-
-	// Write outgoing messages
-	go func() {
-		for msg := range outgoing {
-			ws.WriteMessage(websocket.TextMessage, msg)
-		}
-	}()
+	outbox := user.NewOutbox()
 
 	// Register and receive handle to connection
 	receiveConn := make(chan user.Connection)
-	room.connRequests <- user.NewConnectionRequest(outgoing, session, receiveConn)
+	connReq := user.NewConnectionRequest(outbox, session, connectionEncoding(ws, req), connectionResume(req), receiveConn)
+	for sent := false; !sent; {
+		select {
+		case room.connRequests <- connReq:
+			sent = true
+		case <-room.done:
+			// The room was unloaded after it was looked up, so join the room
+			// that replaces it
+			if room, err = room.registry.GetRoom(room.name, room.registry.DefaultSettings()); room == nil {
+				ws.Close()
+				if err == nil {
+					err = ErrClosed
+				}
+				return err
+			}
+		}
+	}
 	connHandle := <-receiveConn
 
+	// Write outgoing messages and pings until the room removes the connection
+	go func() {
+		defer room.registry.writers.Done()
+		defer ws.Close()
+		ping := time.NewTicker(pingInterval)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case <-outbox.Ready():
+				frames, ok := outbox.Take()
+				if !ok {
+					if code, reason, ok := outbox.CloseFrame(); ok {
+						ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeTimeout))
+					}
+					return
+				}
+				err = writeFrames(ws, frames)
+			case <-ping.C:
+				err = ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			}
+			if err != nil {
+				select {
+				case room.failedWrites <- failedWrite{connHandle, err}:
+				case <-room.done:
+				}
+				return
+			}
+		}
+	}()
+
 	// Read incoming messages
 	go func() {
+		logger := room.connLogger(connHandle)
+		limiter := newConnectionLimiter(room.registry.limits)
+		ws.SetReadLimit(room.registry.limits.MaxMessageSize)
+		// Anything received, including pongs, shows the connection is alive
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(readTimeout))
+		})
+		idle := time.AfterFunc(idleTimeout, func() {
+			outbox.CloseWith(closeIdle, "idle timeout")
+		})
+		defer idle.Stop()
+
 		for {
 			t, msgData, err := ws.ReadMessage()
+			receivedBytes.Add(float64(len(msgData)))
 			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					logger.Info("connection timed out")
+				} else if errors.Is(err, websocket.ErrReadLimit) {
+					logger.Warn("connection sent a message that's too large", "max_size", room.registry.limits.MaxMessageSize)
+				}
 				break
 			}
-			if t == websocket.BinaryMessage {
-				log.Printf("warning: received binary message `%s`", msgData)
+			ws.SetReadDeadline(time.Now().Add(readTimeout))
+			idle.Reset(idleTimeout)
+			var packet c2s.Packet
+			switch t {
+			case websocket.TextMessage:
+				packet, err = c2s.Deserialize(msgData)
+			case websocket.BinaryMessage:
+				packet, err = c2s.DeserializeBinary(msgData)
+			default:
+				continue
 			}
-			if t == websocket.TextMessage {
-				if packet, err := c2s.Deserialize(msgData); err != nil {
-					log.Printf("error decoding incoming packet: %v\n", err)
-				} else {
-					room.incomingMessages <- &message{packet, connHandle}
-				}
+			if err := limiter.allow(packet.Type, len(msgData)); err != nil {
+				packetsRejected.WithLabelValues(packetLabel(packet.Type)).Inc()
+				room.closeLimited(connHandle, err)
+				break
+			}
+			select {
+			case room.incomingMessages <- &message{packet, connHandle, err, len(msgData), time.Now()}:
+			case <-room.done:
+				return
 			}
 		}
 
 		// Send connection to be closed when done receiving messages
-		room.closeConns <- connHandle
+		select {
+		case room.closeConns <- connHandle:
+		case <-room.done:
+		}
 	}()
 
 	return nil
 }
 
+func writeFrames(ws *websocket.Conn, frames []user.Frame) error {
+	for _, frame := range frames {
+		messageType := websocket.TextMessage
+		if frame.Binary {
+			messageType = websocket.BinaryMessage
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := ws.WriteMessage(messageType, frame.Data); err != nil {
+			return err
+		}
+		sentBytes.Add(float64(len(frame.Data)))
+	}
+	return nil
+}
+
+// Clients list the image formats they can decode in the formats query
+// parameter, separated by commas
+func connectionEncoding(ws *websocket.Conn, req *http.Request) user.Encoding {
+	var formats []canvas.Format
+	for _, f := range strings.Split(req.URL.Query().Get("formats"), ",") {
+		formats = append(formats, canvas.Format(f))
+	}
+	return user.Encoding{
+		Binary: ws.Subprotocol() == binarySubprotocol,
+		Format: canvas.BestFormat(formats),
+	}
+}
+
+// Reconnecting clients set the resume, epoch and seq query parameters from the
+// sync_state packet they last received and the last sequence number they saw
+func connectionResume(req *http.Request) user.Resume {
+	query := req.URL.Query()
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 32)
+	if err != nil {
+		return user.Resume{}
+	}
+	return user.Resume{Token: query.Get("resume"), Epoch: query.Get("epoch"), Seq: user.Seq(seq)}
+}
+
 func (room *Room) setupNewConnection(req user.ConnectionRequest) error {
 	previouslyOnline := room.users.OnlineUsers()
 
 	c := room.users.AddConnection(req)
+	room.updateOnlineUserCount()
+	// The first user to join a room owns it
+	if room.owner == 0 {
+		room.owner = c.User
+	}
+
+	// Reconnecting clients that haven't missed too much keep their layers
+	// and are only sent the broadcasts they missed
+	replay, resumed := room.users.Resume(c, req.Resume())
+	if err := c.Send(room.users.NewSyncStatePacket(c, !resumed)); err != nil {
+		return err
+	}
+	if resumed {
+		// Replayed before anything else so old broadcasts don't overwrite
+		// the current state sent below
+		if err := replay(); err != nil {
+			return err
+		}
+	}
 
 	if onlineUsers := room.users.OnlineUsers(); len(previouslyOnline) != len(onlineUsers) {
 		// Inform existing connections that user is now online
@@ -118,6 +469,11 @@ func (room *Room) setupNewConnection(req user.ConnectionRequest) error {
 		return err
 	}
 
+	// Send canvas size to client before any layers
+	if err := c.Send(room.infoPacket()); err != nil {
+		return err
+	}
+
 	// Send usernames to client
 	if err := c.Send(room.users.NewMapNamesPacket()); err != nil {
 		return err
@@ -144,10 +500,42 @@ func (room *Room) setupNewConnection(req user.ConnectionRequest) error {
 		if err := room.users.SendFrom(l.InitPacket(), c); err != nil {
 			return err
 		}
+		if resumed {
+			if err := c.Send(layerpackets.NewS2CCreatePacket(l, height)); err != nil {
+				return err
+			}
+			if err := c.Send(l.InitPacket()); err != nil {
+				return err
+			}
+		}
+	}
+	if resumed {
+		return nil
+	}
+
+	return room.sendLayers(c)
+}
 
+// Sends a connection that fell too far behind everything it would be sent
+// when it connects, except its user id
+func (room *Room) resync(c user.Connection) error {
+	if err := c.Send(room.users.NewSyncStatePacket(c, true)); err != nil {
+		return err
+	}
+	if err := c.Send(room.infoPacket()); err != nil {
+		return err
+	}
+	if err := c.Send(room.users.NewMapNamesPacket()); err != nil {
+		return err
 	}
+	if err := c.Send(room.users.OnlineUsers()); err != nil {
+		return err
+	}
+	return room.sendLayers(c)
+}
 
-	// Inform connection of all existing layers
+// Informs connection of all existing layers
+func (room *Room) sendLayers(c user.Connection) error {
 	for layerHeight, l := range room.layers.Layers {
 		if err := c.Send(layerpackets.NewS2CCreatePacket(l, layerHeight)); err != nil {
 			return err
@@ -159,47 +547,247 @@ func (room *Room) setupNewConnection(req user.ConnectionRequest) error {
 	return nil
 }
 
+// Connections removed early, such as for being slow, are removed again once
+// their reader stops, which does nothing
 func (room *Room) removeConnection(c user.Connection) {
+	if !room.users.Connected(c) {
+		return
+	}
 	room.users.RemoveConnection(c)
+	room.updateOnlineUserCount()
 
 	// Send online users if this was a user's last connection
 	if !room.users.Online(c.User) {
 		if err := room.users.SendToAll(room.users.OnlineUsers()); err != nil {
-			log.Printf("error broadcasting disconnect notification packet: %v\n", err)
+			room.logger.Error("error broadcasting disconnect notification packet", "err", err)
 		}
 	}
 	if room.users.ConnectionCount() == 0 {
-		delete(rooms, UrlName(room.name))
+		room.emptySince = time.Now()
+		if err := room.save(); err != nil {
+			room.logger.Error("error saving room", "err", err)
+		}
+	}
+}
+
+// Catches up connections that fell behind according to the room's
+// backpressure policy
+func (room *Room) catchUp() {
+	for _, lag := range room.users.TakeLagging() {
+		if lag.Disconnect {
+			room.connLogger(lag.Conn).Info("disconnecting slow connection")
+			room.removeConnection(lag.Conn)
+			continue
+		}
+		if lag.Full {
+			if err := room.resync(lag.Conn); err != nil {
+				room.connLogger(lag.Conn).Error("error resyncing slow connection", "err", err)
+			}
+			continue
+		}
+		for _, id := range lag.Layers {
+			// Layers deleted since are already being deleted by the client
+			if l, _ := room.layers.Get(layer.Id(id)); l != nil {
+				room.reply(lag.Conn, l.InitPacket())
+			}
+		}
+	}
+}
+
+func (room *Room) updateOnlineUserCount() {
+	atomic.StoreInt32(&room.onlineUserCount, int32(len(room.users.OnlineUsers())))
+	atomic.StoreInt32(&room.connectionCount, int32(room.users.ConnectionCount()))
+}
+
+// Saves the room and removes it from the registry, which stops its goroutine.
+// Rooms that can't be saved stay loaded so their changes aren't lost
+func (room *Room) unload() {
+	if err := room.save(); err != nil {
+		room.logger.Error("error saving room", "err", err)
+		return
 	}
+	room.registry.unload(room)
+	room.open = false
+}
+
+// Applies the messages already received, closes every connection and saves
+// and unloads the room
+func (room *Room) shutdown() {
+	room.do(func() {
+		for drained := false; !drained; {
+			select {
+			case msg := <-room.incomingMessages:
+				room.handleMessage(msg)
+			default:
+				drained = true
+			}
+		}
+		room.users.CloseAll(websocket.CloseServiceRestart, "server restarting")
+		room.unload()
+		// Rooms that couldn't be saved are stopped anyway
+		room.open = false
+	})
+}
+
+// Writes the room to the store if one is set and there are unsaved changes
+func (room *Room) save() error {
+	roomStore := room.registry.store
+	if roomStore == nil || !room.dirty {
+		return nil
+	}
+	saved, err := room.snapshot()
+	if err != nil {
+		return err
+	}
+	if err := roomStore.Save(UrlName(room.name), saved); err != nil {
+		return err
+	}
+	room.dirty = false
+	return nil
+}
+
+// The room's state in the form it's stored in
+func (room *Room) snapshot() (*store.Room, error) {
+	layers, err := room.layers.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	backpressure := room.backpressure
+	return &store.Room{
+		Name:         room.name,
+		Public:       room.public,
+		Owner:        room.owner,
+		Layers:       layers,
+		Users:        room.users.Snapshot(),
+		Backpressure: &backpressure,
+	}, nil
 }
 
 func (room *Room) handleEvents() {
+	defer close(room.done)
+	autosave := time.NewTicker(autosaveInterval)
+	defer autosave.Stop()
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
+	room.updateStats()
+
 	for room.open {
 		select {
+		case <-autosave.C:
+			if room.users.ConnectionCount() == 0 && time.Since(room.emptySince) >= unloadDelay {
+				room.unload()
+			} else if err := room.save(); err != nil {
+				room.logger.Error("error saving room", "err", err)
+			}
+		case <-stats.C:
+			room.updateStats()
 		case conn := <-room.connRequests:
+			// Accepted connections have a writer until they're closed
+			room.registry.writers.Add(1)
+			if room.full() {
+				room.users.RefuseConnection(conn, websocket.CloseTryAgainLater, ErrRoomFull.Error())
+				break
+			}
+			room.dirty = true
 			if err := room.setupNewConnection(conn); err != nil {
-				if err != nil {
-					log.Printf("error setting up new connection: %v\n", err)
-				}
+				room.logger.Error("error setting up new connection", "err", err)
 			}
 		case conn := <-room.closeConns:
 			room.removeConnection(conn)
+		case failed := <-room.failedWrites:
+			room.connLogger(failed.conn).Info("error writing to connection", "err", failed.err)
+			room.removeConnection(failed.conn)
+		case task := <-room.tasks:
+			task()
 		case msg := <-room.incomingMessages:
-			broadcast, err := msg.Packet.Handle(room.layers, room.users, msg.Sender.User)
-			if err != nil {
-				log.Printf("error applying packet: %v\n", err)
-			}
-			if broadcast != nil {
-				if err := room.users.SendFrom(broadcast, msg.Sender); err != nil {
-					log.Printf("error broadcasting packet: %v\n", err)
-				}
-			}
+			room.handleMessage(msg)
+		}
+		room.catchUp()
+	}
+}
+
+// Applies a packet and tells its sender whether it succeeded
+func (room *Room) handleMessage(msg *message) {
+	// Messages can still be queued from connections that were closed
+	if !room.users.Connected(msg.Sender) {
+		return
+	}
+	messageWait.Observe(time.Since(msg.received).Seconds())
+	label := packetLabel(msg.Packet.Type)
+	if err := room.allowUser(msg.Sender.User, msg.size); err != nil {
+		packetsRejected.WithLabelValues(label).Inc()
+		room.closeLimited(msg.Sender, err)
+		room.removeConnection(msg.Sender)
+		return
+	}
+	if msg.decodeErr != nil {
+		room.messageLogger(msg).Debug("error decoding incoming packet", "err", msg.decodeErr)
+		packetsRejected.WithLabelValues(label).Inc()
+		room.reply(msg.Sender, newErrorPacket(msg.Packet, msg.decodeErr))
+		return
+	}
+
+	start := time.Now()
+	err := room.handle(msg)
+	handlerDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	if err != nil {
+		room.messageLogger(msg).Log(context.Background(), errorLevel(err), "error applying packet", "code", errcode.CodeOf(err), "err", err)
+		packetsRejected.WithLabelValues(label).Inc()
+		room.reply(msg.Sender, newErrorPacket(msg.Packet, err))
+		return
+	}
+	packetsHandled.WithLabelValues(label).Inc()
+}
+
+func (room *Room) reply(c user.Connection, packet user.OutgoingPacket) {
+	if err := c.Send(packet); err != nil {
+		room.connLogger(c).Error("error replying to packet", "err", err)
+	}
+}
+
+// Packets rejected because of what the client sent are expected, so they're
+// only logged when debugging
+func errorLevel(err error) slog.Level {
+	if errcode.CodeOf(err) == errcode.Internal {
+		return slog.LevelError
+	}
+	return slog.LevelDebug
+}
+
+// Applies a packet, then broadcasts and acknowledges it. Panics, including
+// ones serializing the broadcast or ack, are recovered from and returned as
+// internal errors, so a bad packet can't stop the room
+func (room *Room) handle(msg *message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			handlerPanics.Inc()
+			room.messageLogger(msg).Error("panic handling packet", "panic", r, "stack", string(debug.Stack()))
+			err = errcode.Errorf(errcode.Internal, "panic handling packet: %v", r)
+		}
+	}()
+	broadcast, err := room.apply(msg)
+	if err != nil {
+		return err
+	}
+	room.dirty = true
+	if broadcast != nil {
+		if err := room.users.SendFrom(broadcast, msg.Sender); err != nil {
+			room.messageLogger(msg).Error("error broadcasting packet", "err", err)
 		}
 	}
+	if msg.Packet.RequestId != 0 {
+		room.reply(msg.Sender, &ackPacket{msg.Packet.RequestId})
+	}
+	return nil
 }
 
-var wsupgrader = websocket.Upgrader{
-	ReadBufferSize:    canvas.Height * canvas.Width * 4 * 10, // 1024,
-	WriteBufferSize:   canvas.Height * canvas.Width * 4 * 10, // 1024,
-	EnableCompression: true,
+func (room *Room) apply(msg *message) (user.OutgoingPacket, error) {
+	if p, ok := msg.Packet.Handler.(roomHandler); ok {
+		return p.handleRoom(room, msg.Sender)
+	}
+	return msg.Packet.Handler.Handle(room.layers, room.users, msg.Sender.User)
 }
+
+// Clients that negotiate this subprotocol are sent pixel data as binary
+// messages. Binary messages are accepted from every client
+const binarySubprotocol = "whiteboard-binary-v1"
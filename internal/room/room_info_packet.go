@@ -0,0 +1,21 @@
+package room
+
+import "github.com/turtlearmy/online-whiteboard/internal/user"
+
+const packet_type_room_info = "room_info"
+
+// Sent to connections when they join and to everyone when the room changes
+type roomInfoPacket struct {
+	Name   string  `json:"name"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Owner  user.Id `json:"owner"`
+}
+
+func (*roomInfoPacket) PacketType() string {
+	return packet_type_room_info
+}
+
+func (room *Room) infoPacket() user.OutgoingPacket {
+	return &roomInfoPacket{room.name, room.layers.Width, room.layers.Height, room.owner}
+}
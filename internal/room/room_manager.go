@@ -1,33 +1,317 @@
 package room
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
+
+	"github.com/gorilla/websocket"
+	"github.com/turtlearmy/online-whiteboard/internal/ora"
+	"github.com/turtlearmy/online-whiteboard/internal/store"
 )
 
 var valid_name_re = regexp.MustCompile("^[a-z0-9][a-z0-9_]*$")
 
-var rooms = map[string]*Room{}
+// Keeps track of loaded rooms. Safe to use from multiple goroutines
+type RoomRegistry struct {
+	mutex sync.Mutex
+	rooms map[string]*Room
+	// Rooms being loaded from or deleted from the store, which is done
+	// without the mutex locked. Closed once the store is done with the room
+	pending map[string]chan struct{}
+	// Used to save rooms when they are unloaded and restore them when they
+	// are next requested. Rooms are only kept in memory if store is nil
+	store store.Store
+	// Settings of rooms created without their own
+	defaults Settings
+	// Used by every room
+	limits   Limits
+	upgrader websocket.Upgrader
+	// Set once the server starts shutting down, after which no rooms are
+	// loaded
+	closed bool
+	// Writers of connections accepted by rooms, which finish once their
+	// connection is closed
+	writers sync.WaitGroup
+	// Number of health checks, used to check each room in turn
+	pings uint64
+}
+
+type Options struct {
+	// Rooms are only kept in memory if Store is nil
+	Store store.Store
+	// Settings of rooms created without their own
+	Defaults Settings
+	Limits   Limits
+	// Sizes in bytes of each websocket's buffers. They don't limit the size of
+	// messages, since larger messages are split into multiple frames
+	ReadBufferSize, WriteBufferSize int
+}
+
+func NewRoomRegistry(options Options) *RoomRegistry {
+	return &RoomRegistry{
+		rooms:    map[string]*Room{},
+		pending:  map[string]chan struct{}{},
+		store:    options.Store,
+		defaults: options.Defaults,
+		limits:   options.Limits,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:    options.ReadBufferSize,
+			WriteBufferSize:   options.WriteBufferSize,
+			EnableCompression: true,
+			Subprotocols:      []string{binarySubprotocol},
+		},
+	}
+}
+
+func (registry *RoomRegistry) DefaultSettings() Settings {
+	return registry.defaults
+}
+
+func (registry *RoomRegistry) Limits() Limits {
+	return registry.limits
+}
 
 func ValidName(name string) bool {
 	return valid_name_re.MatchString(UrlName(name))
 }
 
-// Gets or creates room.
-// public is ignored if the room already exists
-func GetRoom(name string, public bool) *Room {
+// Gets, restores from the store or creates room.
+// settings are ignored if the room already exists. Returns nil without an
+// error if the name or settings are invalid
+func (registry *RoomRegistry) GetRoom(name string, settings Settings) (*Room, error) {
+	if !ValidName(name) || !registry.limits.ValidCanvasSize(settings.Width, settings.Height) {
+		return nil, nil
+	}
+	key := UrlName(name)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	room, err := registry.lookup(key)
+	if room != nil || err != nil {
+		return room, err
+	}
+	if registry.full() {
+		return nil, ErrTooManyRooms
+	}
+	room = newRoom(registry, name, settings)
+	registry.rooms[key] = room
+	return room, nil
+}
+
+// Gets or restores room from the store without creating it. Returns nil
+// without an error if it doesn't exist
+func (registry *RoomRegistry) LookupRoom(name string) (*Room, error) {
 	if !ValidName(name) {
-		return nil
+		return nil, nil
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.lookup(UrlName(name))
+}
+
+// Creates a new room from an OpenRaster archive. Fails if the room already
+// exists
+func (registry *RoomRegistry) ImportRoom(name string, public bool, archive io.ReaderAt, size int64) (*Room, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid room name '%s'", name)
 	}
 	key := UrlName(name)
-	room := rooms[key]
+	layers, err := ora.Read(archive, size, registry.limits.MaxCanvasArea)
+	if err != nil {
+		return nil, err
+	}
+
+	registry.mutex.Lock()
+	existing, err := registry.lookup(key)
+	if err != nil {
+		registry.mutex.Unlock()
+		return nil, err
+	}
+	if existing != nil {
+		registry.mutex.Unlock()
+		return nil, fmt.Errorf("room '%s' already exists", key)
+	}
+	if registry.full() {
+		registry.mutex.Unlock()
+		return nil, ErrTooManyRooms
+	}
+	room := importRoom(registry, name, public, layers)
+	registry.rooms[key] = room
+	registry.mutex.Unlock()
+
+	// Make sure the room is stored even if nobody connects before the server
+	// stops
+	room.do(func() {
+		if err := room.save(); err != nil {
+			room.logger.Error("error saving room", "err", err)
+		}
+	})
+	return room, nil
+}
+
+// Gets a loaded room or restores it from the store. Returns nil without an
+// error if the room doesn't exist, or ErrClosed once the registry is closed.
+// Must be called with the mutex locked. The mutex is unlocked while the room is
+// loaded, so loading a room doesn't hold up others
+func (registry *RoomRegistry) lookup(key string) (*Room, error) {
+	for registry.waitPending(key) {
+	}
+	if registry.closed {
+		return nil, ErrClosed
+	}
+	if room := registry.rooms[key]; room != nil {
+		return room, nil
+	}
+	if registry.store == nil {
+		return nil, nil
+	}
+	if registry.full() {
+		return nil, ErrTooManyRooms
+	}
+
+	release := registry.claim(key)
+	registry.mutex.Unlock()
+	room, err := registry.load(key)
+	registry.mutex.Lock()
+	release()
 	if room == nil {
-		room = newRoom(name, public)
-		rooms[key] = room
+		return nil, err
+	}
+	if registry.closed {
+		// Shutdown has already stopped every room it knew of
+		go room.shutdown()
+		return nil, ErrClosed
+	}
+	registry.rooms[key] = room
+	return room, nil
+}
+
+func (registry *RoomRegistry) load(key string) (*Room, error) {
+	saved, err := registry.store.Load(key)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return restoreRoom(registry, saved)
+}
+
+// Whether no more rooms can be loaded. Rooms being loaded count towards the
+// limit. Must be called with the mutex locked
+func (registry *RoomRegistry) full() bool {
+	limit := registry.limits.MaxLoadedRooms
+	return limit > 0 && len(registry.rooms)+len(registry.pending) >= limit
+}
+
+// Marks a room as being loaded or deleted, so lookups of it wait until release
+// is called. Both must be called with the mutex locked
+func (registry *RoomRegistry) claim(key string) (release func()) {
+	done := make(chan struct{})
+	registry.pending[key] = done
+	return func() {
+		delete(registry.pending, key)
+		close(done)
+	}
+}
+
+// Waits for a room that's being loaded or deleted. Returns false if it didn't
+// need to. Must be called with the mutex locked, which is unlocked while
+// waiting
+func (registry *RoomRegistry) waitPending(key string) bool {
+	done := registry.pending[key]
+	if done == nil {
+		return false
+	}
+	registry.mutex.Unlock()
+	<-done
+	registry.mutex.Lock()
+	return true
+}
+
+// Called by a room's goroutine once it's saved. The room must not handle any
+// more events after this, since it may be restored from the store by the next
+// request for it
+func (registry *RoomRegistry) unload(room *Room) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	key := UrlName(room.name)
+	if registry.rooms[key] == room {
+		delete(registry.rooms, key)
+	}
+}
+
+// Stops loading rooms, then closes every connection and saves and unloads
+// every room. Returns ctx's error if it's done first
+func (registry *RoomRegistry) Shutdown(ctx context.Context) error {
+	registry.mutex.Lock()
+	registry.closed = true
+	rooms := make([]*Room, 0, len(registry.rooms))
+	for _, room := range registry.rooms {
+		rooms = append(rooms, room)
+	}
+	registry.mutex.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, room := range rooms {
+			wg.Add(1)
+			go func(room *Room) {
+				defer wg.Done()
+				room.shutdown()
+			}(room)
+		}
+		wg.Wait()
+		// Give writers time to send what's queued and their close frames
+		registry.writers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Checks that rooms are handling events by waiting for one of them to run a
+// task. Rooms take turns being checked
+func (registry *RoomRegistry) Ping(ctx context.Context) error {
+	rooms := registry.LoadedRooms()
+	if len(rooms) == 0 {
+		return nil
+	}
+	room := rooms[atomic.AddUint64(&registry.pings, 1)%uint64(len(rooms))]
+	err := room.doContext(ctx, func() {})
+	if err != nil && !errors.Is(err, ErrClosed) {
+		return fmt.Errorf("room '%s' isn't responding: %w", room.name, err)
 	}
-	return room
+	return nil
+}
+
+// Returns an error once the registry starts shutting down or if its store
+// can't be used
+func (registry *RoomRegistry) Ready() error {
+	registry.mutex.Lock()
+	closed := registry.closed
+	registry.mutex.Unlock()
+	if closed {
+		return errors.New("shutting down")
+	}
+	if registry.store != nil {
+		if err := registry.store.Ping(); err != nil {
+			return fmt.Errorf("store isn't usable: %w", err)
+		}
+	}
+	return nil
 }
 
 type Info struct {
@@ -35,13 +319,16 @@ type Info struct {
 	OnlineUserCount int
 }
 
-func PublicRooms() []Info {
+func (registry *RoomRegistry) PublicRooms() []Info {
+	registry.mutex.Lock()
 	list := []Info{}
-	for _, room := range rooms {
+	for _, room := range registry.rooms {
 		if room.public {
-			list = append(list, Info{room.name, len(room.users.OnlineUsers())})
+			list = append(list, Info{room.name, room.OnlineUserCount()})
 		}
 	}
+	registry.mutex.Unlock()
+
 	// Show rooms with most users first
 	sort.Slice(list, func(i, j int) bool {
 		if list[i].OnlineUserCount != list[j].OnlineUserCount {
@@ -1,9 +1,8 @@
 package room
 
 import (
-	"fmt"
-
 	"github.com/turtlearmy/online-whiteboard/internal/c2s"
+	"github.com/turtlearmy/online-whiteboard/internal/errcode"
 	"github.com/turtlearmy/online-whiteboard/internal/layer"
 	"github.com/turtlearmy/online-whiteboard/internal/user"
 )
@@ -25,7 +24,8 @@ func (packet *SetNamePacket) Handle(layers *layer.Manager, users *user.Manager,
 	senderName := users.Name(sender)
 	if packet.Id != sender {
 		setName := users.Name(packet.Id)
-		return nil, fmt.Errorf(
+		return nil, errcode.Errorf(
+			errcode.PermissionDenied,
 			"user '%s' (id %d) attempted set name of user '%s' (id %d) to '%s'",
 			senderName,
 			sender,
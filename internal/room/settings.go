@@ -0,0 +1,19 @@
+package room
+
+import (
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+// Used when creating a room. Ignored if the room already exists
+type Settings struct {
+	Public bool
+	// Size of the room's canvas
+	Width, Height int
+	// What happens to connections that fall behind
+	Backpressure user.Backpressure
+}
+
+func DefaultSettings() Settings {
+	return Settings{false, canvas.DefaultWidth, canvas.DefaultHeight, user.DefaultBackpressure()}
+}
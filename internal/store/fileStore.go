@@ -0,0 +1,114 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stores each room as a json file in a directory
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir}, nil
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	// Keys come from room names, so make sure they can't escape the directory
+	if key == "" || key != filepath.Base(key) || key[0] == '.' {
+		return "", fmt.Errorf("invalid room key '%s'", key)
+	}
+	return filepath.Join(s.dir, key+".json"), nil
+}
+
+func (s *FileStore) Load(key string) (*Room, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	room := &Room{}
+	if err := json.Unmarshal(data, room); err != nil {
+		return nil, fmt.Errorf("error decoding stored room '%s': %w", key, err)
+	}
+	return room, nil
+}
+
+func (s *FileStore) Save(key string, room *Room) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash mid write can't corrupt the
+	// previously saved state
+	tmp, err := os.CreateTemp(s.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		// Skips temporary files and the file written by Ping
+		key, ok := strings.CutSuffix(entry.Name(), ".json")
+		if ok && entry.Type().IsRegular() && key != "" && key[0] != '.' {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Writes and removes a file to check the directory can still be written to
+func (s *FileStore) Ping() error {
+	f, err := os.CreateTemp(s.dir, ".ping-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
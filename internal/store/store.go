@@ -0,0 +1,34 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/turtlearmy/online-whiteboard/internal/layer"
+	"github.com/turtlearmy/online-whiteboard/internal/user"
+)
+
+var ErrNotFound = errors.New("room not found in store")
+
+// Persisted state of a room
+type Room struct {
+	Name   string                `json:"name"`
+	Public bool                  `json:"public"`
+	Owner  user.Id               `json:"owner"`
+	Layers layer.ManagerSnapshot `json:"layers"`
+	Users  user.Snapshot         `json:"users"`
+	// Rooms stored before this was added use the default
+	Backpressure *user.Backpressure `json:"backpressure,omitempty"`
+}
+
+// Used to persist rooms between their connections closing and server restarts.
+// Rooms are identified by their url name
+type Store interface {
+	// Returns ErrNotFound if no room is stored with the key
+	Load(key string) (*Room, error)
+	Save(key string, room *Room) error
+	Delete(key string) error
+	// Keys of every stored room
+	List() ([]string, error)
+	// Returns an error if rooms can't currently be saved
+	Ping() error
+}
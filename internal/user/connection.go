@@ -4,28 +4,66 @@ package user
 type connectionId uint
 
 type Connection struct {
-	outgoing chan<- []byte
+	outbox   *Outbox
 	User     Id
 	id       connectionId
+	encoding Encoding
+	// Identifies the connection to the client, which it uses to resume the
+	// connection if it's lost
+	token string
+}
+
+// Identifies the connection in logs
+func (c *Connection) Id() uint {
+	return uint(c.id)
 }
 
 func (c *Connection) Send(packet OutgoingPacket) error {
-	data, err := serializePacket(packet)
+	return c.send(newSerializer(packet))
+}
+
+// Closes the connection with a close frame once what's already been sent is
+// written. The connection is removed once its reader stops
+func (c *Connection) Close(code int, reason string) {
+	c.outbox.CloseWith(code, reason)
+}
+
+func (c *Connection) send(s *serializer) error {
+	return c.queue(s, false)
+}
+
+// Broadcasts count towards the room's backpressure limits
+func (c *Connection) broadcast(s *serializer) error {
+	return c.queue(s, true)
+}
+
+func (c *Connection) queue(s *serializer, broadcast bool) error {
+	frame, err := s.frame(c.encoding)
 	if err != nil {
 		return err
 	}
-	c.outgoing <- data
+	f := queuedFrame{Frame: frame, broadcast: broadcast}
+	if p, ok := s.packet.(LayerContentPacket); ok {
+		f.layer, f.hasLayer = p.ContentLayer(), true
+	}
+	c.outbox.push(f)
 	return nil
 }
 
 type ConnectionRequest struct {
-	outgoing    chan<- []byte
+	outbox      *Outbox
 	session     Session
+	encoding    Encoding
+	resume      Resume
 	receiveConn chan<- Connection
 }
 
 // receiveConn is used to return a handle for the connection to where the
 // connection was requested
-func NewConnectionRequest(outgoing chan<- []byte, session Session, receiveConn chan<- Connection) ConnectionRequest {
-	return ConnectionRequest{outgoing, session, receiveConn}
+func NewConnectionRequest(outbox *Outbox, session Session, encoding Encoding, resume Resume, receiveConn chan<- Connection) ConnectionRequest {
+	return ConnectionRequest{outbox, session, encoding, resume, receiveConn}
+}
+
+func (req *ConnectionRequest) Resume() Resume {
+	return req.resume
 }
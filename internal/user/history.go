@@ -0,0 +1,89 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// How many broadcasts are kept to be replayed to reconnecting connections, and
+// the most bytes they can use. Connections that missed more than this get the
+// room's full state instead
+const (
+	historyLength   = 512
+	historyMaxBytes = 64 << 20
+)
+
+// Sequence numbers of broadcasts start at 1. Packets sent to a single
+// connection have a sequence number of 0 and aren't replayed
+type Seq uint32
+
+// Sent by a reconnecting client to receive only the broadcasts it missed
+type Resume struct {
+	// Identifies the connection that was lost, so broadcasts it sent aren't
+	// replayed back to it
+	Token string
+	// Identifies the manager the connection was lost from. Sequence numbers
+	// from a different manager, e.g. from before the server restarted, are
+	// meaningless
+	Epoch string
+	// The last sequence number the client received
+	Seq Seq
+}
+
+type broadcast struct {
+	seq Seq
+	s   *serializer
+	// Token of the connection the broadcast wasn't sent to, if any
+	except string
+}
+
+// The most recent broadcasts, oldest first
+type history struct {
+	epoch   string
+	seq     Seq
+	entries []broadcast
+}
+
+func newHistory() history {
+	return history{epoch: newToken()}
+}
+
+// Stamps s with the next sequence number and stores it, dropping the oldest
+// broadcasts once there are too many or they use too much memory
+func (h *history) add(s *serializer, except string) {
+	h.seq++
+	s.seq = h.seq
+	h.entries = append(h.entries, broadcast{h.seq, s, except})
+
+	// Serializers grow as they're sent in more encodings, so their size is
+	// counted again each time
+	bytes := 0
+	for _, b := range h.entries {
+		bytes += b.s.size()
+	}
+	drop := 0
+	for ; drop < len(h.entries) && (len(h.entries)-drop > historyLength || bytes > historyMaxBytes); drop++ {
+		bytes -= h.entries[drop].s.size()
+		h.entries[drop] = broadcast{}
+	}
+	h.entries = h.entries[drop:]
+}
+
+// Returns the broadcasts after seq in order, or false if some of them are no
+// longer stored
+func (h *history) since(resume Resume) ([]broadcast, bool) {
+	if resume.Epoch != h.epoch || resume.Seq > h.seq {
+		return nil, false
+	}
+	missed := int(h.seq - resume.Seq)
+	if missed > len(h.entries) {
+		return nil, false
+	}
+	return h.entries[len(h.entries)-missed:], true
+}
+
+func newToken() string {
+	bytes := make([]byte, 12)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
@@ -2,6 +2,7 @@ package user
 
 import (
 	"fmt"
+	"sort"
 )
 
 type Manager struct {
@@ -12,10 +13,26 @@ type Manager struct {
 	nextConnId  connectionId
 
 	names map[Id]string
+
+	// Recent broadcasts, replayed to connections that reconnect
+	history history
+
+	backpressure Backpressure
 }
 
 func NewManager() *Manager {
-	return &Manager{sessions: map[Session]Id{}, connections: map[connectionId]Connection{}, names: map[Id]string{}}
+	return &Manager{
+		sessions:     map[Session]Id{},
+		connections:  map[connectionId]Connection{},
+		names:        map[Id]string{},
+		history:      newHistory(),
+		backpressure: DefaultBackpressure(),
+	}
+}
+
+// Sets the limits for connections added after this
+func (users *Manager) SetBackpressure(b Backpressure) {
+	users.backpressure = b
 }
 
 func (users *Manager) ForSession(session Session) Id {
@@ -34,7 +51,8 @@ func (users *Manager) AddConnection(req ConnectionRequest) Connection {
 	users.nextConnId++ // Start ids at 1 and not 0
 	id := users.nextConnId
 
-	c := Connection{req.outgoing, u, id}
+	c := Connection{req.outbox, u, id, req.encoding, users.resumeToken(req.resume)}
+	c.outbox.setLimits(users.backpressure)
 
 	users.connections[c.id] = c
 
@@ -44,14 +62,105 @@ func (users *Manager) AddConnection(req ConnectionRequest) Connection {
 	return c
 }
 
+// Closes a requested connection with a close frame instead of adding it. The
+// handle sent back is never connected
+func (users *Manager) RefuseConnection(req ConnectionRequest, code int, reason string) {
+	req.outbox.CloseWith(code, reason)
+	req.receiveConn <- Connection{outbox: req.outbox}
+}
+
+// Reconnecting connections keep their token so broadcasts they sent aren't
+// replayed to them
+func (users *Manager) resumeToken(resume Resume) string {
+	if resume.Token == "" {
+		return newToken()
+	}
+	for _, c := range users.connections {
+		if c.token == resume.Token {
+			return newToken()
+		}
+	}
+	return resume.Token
+}
+
+// Returns a function that sends a reconnecting connection the broadcasts it
+// missed, or false if they're no longer all stored and the connection needs
+// the full state instead. Connections whose token was already in use were
+// given a new one, and also need the full state
+func (users *Manager) Resume(c Connection, resume Resume) (replay func() error, ok bool) {
+	if resume.Token == "" || resume.Token != c.token {
+		return nil, false
+	}
+	missed, ok := users.history.since(resume)
+	if !ok {
+		return nil, false
+	}
+	return func() error {
+		for _, b := range missed {
+			if b.except == c.token {
+				continue
+			}
+			if err := c.send(b.s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, true
+}
+
+func (users *Manager) NewSyncStatePacket(c Connection, full bool) OutgoingPacket {
+	return &syncStatePacket{users.history.epoch, c.token, users.history.seq, full}
+}
+
+// Closes the connection's outbox, which stops its writer
 func (users *Manager) RemoveConnection(c Connection) {
+	if _, ok := users.connections[c.id]; !ok {
+		return
+	}
 	delete(users.connections, c.id)
+	c.outbox.Close()
+}
+
+// Closes every connection with a close frame, without removing them
+func (users *Manager) CloseAll(code int, reason string) {
+	for _, c := range users.connections {
+		c.outbox.CloseWith(code, reason)
+	}
+}
+
+// Takes the connections that fell behind since this was last called, which
+// the room needs to catch up
+func (users *Manager) TakeLagging() []Lag {
+	var lagging []Lag
+	for _, c := range users.connections {
+		if lag, ok := c.outbox.takeLag(); ok {
+			lag.Conn = c
+			lagging = append(lagging, lag)
+		}
+	}
+	return lagging
+}
+
+// Whether the connection hasn't been removed
+func (users *Manager) Connected(c Connection) bool {
+	_, ok := users.connections[c.id]
+	return ok
 }
 
 func (users *Manager) ConnectionCount() int {
 	return len(users.connections)
 }
 
+// Frames waiting to be written to every connection and their size in bytes
+func (users *Manager) Queued() (frames, bytes int) {
+	for _, c := range users.connections {
+		f, b := c.outbox.Queued()
+		frames += f
+		bytes += b
+	}
+	return frames, bytes
+}
+
 func (users *Manager) Online(u Id) bool {
 	for _, c := range users.connections {
 		if u == c.User {
@@ -73,6 +182,37 @@ func (users *Manager) OnlineUsers() OnlineUserIdsPacket {
 	return onlineUsers
 }
 
+// Every user that has joined, in order of id
+func (users *Manager) Users() []Id {
+	ids := make([]Id, 0, len(users.sessions))
+	for _, id := range users.sessions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Whether the user has ever joined
+func (users *Manager) Known(u Id) bool {
+	return 0 < u && u <= users.nextUserId
+}
+
+// Connections of every user, in order of id
+func (users *Manager) Connections() []Connection {
+	connections := make([]Connection, 0, len(users.connections))
+	for _, c := range users.connections {
+		connections = append(connections, c)
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].id < connections[j].id })
+	return connections
+}
+
+// Gets a connection by the id from its Id method
+func (users *Manager) Connection(id uint) (Connection, bool) {
+	c, ok := users.connections[connectionId(id)]
+	return c, ok
+}
+
 func (users *Manager) Name(user Id) string {
 	if name, ok := users.names[user]; ok {
 		return name
@@ -85,27 +225,25 @@ func (users *Manager) SetName(user Id, name string) {
 }
 
 func (users *Manager) SendToAll(packet OutgoingPacket) error {
-	data, err := serializePacket(packet)
-	if err != nil {
-		return err
-	}
-
+	s := newSerializer(packet)
+	users.history.add(s, "")
 	for _, connection := range users.connections {
-		connection.outgoing <- data
+		if err := connection.broadcast(s); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // Broadcast packet to all but the sender
 func (users *Manager) SendFrom(packet OutgoingPacket, sender Connection) error {
-	data, err := serializePacket(packet)
-	if err != nil {
-		return err
-	}
-
+	s := newSerializer(packet)
+	users.history.add(s, sender.token)
 	for id, connection := range users.connections {
 		if id != sender.id {
-			connection.outgoing <- data
+			if err := connection.broadcast(s); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,266 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// What happens to a connection that has too many broadcasts waiting to be
+// written to it
+type Policy string
+
+const (
+	// Drops everything waiting to be written and sends the room's state again
+	DropAndResync Policy = "drop_and_resync"
+	// Replaces waiting changes to layer contents with each layer's current
+	// contents, and falls back to DropAndResync if that isn't enough
+	CoalesceDraws Policy = "coalesce_draws"
+	// Closes the connection with CloseTooSlow
+	Disconnect Policy = "disconnect"
+)
+
+// Close code of connections closed by the Disconnect policy. Clients shouldn't
+// reconnect straight away, since they'd likely fall behind again
+const CloseTooSlow = 4002
+
+func (p Policy) Valid() bool {
+	return p == DropAndResync || p == CoalesceDraws || p == Disconnect
+}
+
+// Limits on the broadcasts waiting to be written to each connection of a room.
+// Packets sent to a single connection don't count towards the limits, so a
+// connection can always be sent the room's state
+type Backpressure struct {
+	Policy      Policy `json:"policy" yaml:"policy"`
+	MaxMessages int    `json:"max_messages" yaml:"max_messages"`
+	MaxBytes    int    `json:"max_bytes" yaml:"max_bytes"`
+}
+
+func DefaultBackpressure() Backpressure {
+	return Backpressure{CoalesceDraws, 1024, 16 << 20}
+}
+
+func (b Backpressure) Validate() error {
+	if !b.Policy.Valid() {
+		return fmt.Errorf("unknown backpressure policy %q", b.Policy)
+	}
+	if b.MaxMessages <= 0 || b.MaxBytes <= 0 {
+		return errors.New("backpressure limits must be positive")
+	}
+	return nil
+}
+
+// Implemented by packets that only change the contents of a layer. They can be
+// replaced by the layer's current contents when a connection falls behind
+type LayerContentPacket interface {
+	OutgoingPacket
+	ContentLayer() uint32
+}
+
+type queuedFrame struct {
+	Frame
+	// Whether the frame counts towards the backpressure limits
+	broadcast bool
+	// Set for frames of LayerContentPackets
+	layer    uint32
+	hasLayer bool
+}
+
+// Frames waiting to be written to a connection. Sending never blocks, so a
+// slow connection can't hold up the room
+type Outbox struct {
+	mutex  sync.Mutex
+	frames []queuedFrame
+	// Number of queued broadcasts and their size in bytes
+	messages, bytes int
+	limits          Backpressure
+	closed          bool
+	// Sent in a close frame once the outbox is closed, if set
+	closeCode   int
+	closeReason string
+	// Has a value while frames are queued or the outbox is closed
+	ready chan struct{}
+
+	// How the connection has fallen behind since the room last caught it up
+	lag Lag
+}
+
+// A connection that has fallen behind and needs to be caught up by the room
+type Lag struct {
+	Conn Connection
+	// Needs the room's whole state
+	Full bool
+	// Needs the current contents of these layers
+	Layers []uint32
+	// Was closed and should be removed
+	Disconnect bool
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{limits: DefaultBackpressure(), ready: make(chan struct{}, 1)}
+}
+
+// Has a value when there may be frames to take or the outbox was closed
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Takes the queued frames. Returns false once the outbox is closed and every
+// frame has been taken
+func (o *Outbox) Take() ([]Frame, bool) {
+	o.mutex.Lock()
+	queued := o.frames
+	closed := o.closed
+	o.frames = nil
+	o.messages, o.bytes = 0, 0
+	if closed {
+		// Stay ready so the writer sees the outbox is closed
+		o.signal()
+	}
+	o.mutex.Unlock()
+
+	if len(queued) == 0 {
+		return nil, !closed
+	}
+	frames := make([]Frame, len(queued))
+	for i, f := range queued {
+		frames[i] = f.Frame
+	}
+	return frames, true
+}
+
+// Closes the outbox once the frames already queued have been taken
+func (o *Outbox) Close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.closed = true
+	o.signal()
+}
+
+// Closes the outbox, and has its writer send a close frame after the frames
+// already queued
+func (o *Outbox) CloseWith(code int, reason string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return
+	}
+	o.closeCode, o.closeReason = code, reason
+	o.closed = true
+	o.signal()
+}
+
+// The close frame to send once the outbox is closed. Returns false if none
+// should be sent
+func (o *Outbox) CloseFrame() (code int, reason string, ok bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.closeCode, o.closeReason, o.closeCode != 0
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Number of frames waiting to be written and their size in bytes
+func (o *Outbox) Queued() (frames, bytes int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, f := range o.frames {
+		bytes += len(f.Data)
+	}
+	return len(o.frames), bytes
+}
+
+func (o *Outbox) setLimits(limits Backpressure) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.limits = limits
+}
+
+func (o *Outbox) push(f queuedFrame) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return
+	}
+	// Broadcasts are dropped until the connection is sent the whole state
+	if f.broadcast && o.lag.Full {
+		return
+	}
+	o.frames = append(o.frames, f)
+	if f.broadcast {
+		o.messages++
+		o.bytes += len(f.Data)
+	}
+	if o.overLimits() {
+		o.relieve()
+	}
+	o.signal()
+}
+
+func (o *Outbox) overLimits() bool {
+	return o.messages > o.limits.MaxMessages || o.bytes > o.limits.MaxBytes
+}
+
+// Applies the backpressure policy
+func (o *Outbox) relieve() {
+	switch o.limits.Policy {
+	case Disconnect:
+		o.frames = nil
+		o.messages, o.bytes = 0, 0
+		o.closed = true
+		o.closeCode, o.closeReason = CloseTooSlow, "connection fell too far behind"
+		o.lag.Disconnect = true
+		return
+	case CoalesceDraws:
+		o.coalesce()
+		if !o.overLimits() {
+			return
+		}
+	}
+	o.frames = nil
+	o.messages, o.bytes = 0, 0
+	o.lag.Full = true
+	o.lag.Layers = nil
+}
+
+// Removes queued layer content broadcasts, remembering which layers they were
+// for
+func (o *Outbox) coalesce() {
+	kept := o.frames[:0]
+	for _, f := range o.frames {
+		if !f.broadcast || !f.hasLayer {
+			kept = append(kept, f)
+			continue
+		}
+		o.messages--
+		o.bytes -= len(f.Data)
+		if !containsLayer(o.lag.Layers, f.layer) {
+			o.lag.Layers = append(o.lag.Layers, f.layer)
+		}
+	}
+	o.frames = kept
+}
+
+func containsLayer(layers []uint32, layer uint32) bool {
+	for _, l := range layers {
+		if l == layer {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns and resets how the connection has fallen behind
+func (o *Outbox) takeLag() (Lag, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	lag := o.lag
+	o.lag = Lag{}
+	return lag, lag.Full || len(lag.Layers) > 0 || lag.Disconnect
+}
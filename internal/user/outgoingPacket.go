@@ -1,15 +1,132 @@
 package user
 
-import "encoding/json"
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/turtlearmy/online-whiteboard/internal/layer/canvas"
+)
 
 type OutgoingPacket interface {
 	PacketType() string
 }
 
-func serializePacket(p OutgoingPacket) ([]byte, error) {
-	return json.Marshal(
-		map[string]interface{}{
-			"type": p.PacketType(),
-			"data": p,
-		})
+// Implemented by packets with a binary form, which is sent instead of json to
+// connections that support binary messages
+type BinaryPacket interface {
+	OutgoingPacket
+	// The first byte of the packet
+	BinaryType() byte
+	// Encodes the rest of the packet after its type and request id
+	EncodeBinary(format canvas.Format) ([]byte, error)
+}
+
+// Space for the type and request id at the start of binary packets. Packets
+// sent by the server have their sequence number in place of a request id
+const binaryHeaderSize = 5
+
+// Implemented by packets containing images, so they can be sent in a format
+// the receiving connection supports
+type ImagePacket interface {
+	OutgoingPacket
+	WithFormat(format canvas.Format) (OutgoingPacket, error)
+}
+
+// Implemented by packets that hold a lot of memory, such as decoded images, so
+// it counts towards the memory used by broadcasts kept to be replayed
+type MemoryUser interface {
+	// Number of bytes held by the packet
+	MemoryUsage() int
+}
+
+// How packets are serialized for a connection
+type Encoding struct {
+	Binary bool
+	// Format images are sent in
+	Format canvas.Format
+}
+
+// A serialized packet waiting to be written to a websocket
+type Frame struct {
+	Data   []byte
+	Binary bool
+}
+
+func serializePacket(p OutgoingPacket, seq Seq) ([]byte, error) {
+	msg := map[string]interface{}{
+		"type": p.PacketType(),
+		"data": p,
+	}
+	if seq != 0 {
+		msg["seq"] = seq
+	}
+	return json.Marshal(msg)
+}
+
+// Serializes a packet at most once for each encoding it's sent in, so
+// broadcasts aren't serialized again for every connection
+type serializer struct {
+	packet OutgoingPacket
+	// Set for broadcasts before they're serialized
+	seq    Seq
+	frames map[Encoding]Frame
+}
+
+func newSerializer(packet OutgoingPacket) *serializer {
+	return &serializer{packet, 0, map[Encoding]Frame{}}
+}
+
+// Bytes held by the packet and its serialized frames
+func (s *serializer) size() int {
+	size := 0
+	if m, ok := s.packet.(MemoryUser); ok {
+		size += m.MemoryUsage()
+	}
+	for _, f := range s.frames {
+		size += len(f.Data)
+	}
+	return size
+}
+
+func (s *serializer) frame(encoding Encoding) (Frame, error) {
+	binaryPacket, isBinary := s.packet.(BinaryPacket)
+	imagePacket, hasImages := s.packet.(ImagePacket)
+	// Ignore parts of the encoding that don't affect this packet, so fewer
+	// forms are serialized
+	if !isBinary {
+		encoding.Binary = false
+	}
+	if !isBinary && !hasImages {
+		encoding.Format = ""
+	}
+	if frame, ok := s.frames[encoding]; ok {
+		return frame, nil
+	}
+
+	var frame Frame
+	if encoding.Binary {
+		data, err := binaryPacket.EncodeBinary(encoding.Format)
+		if err != nil {
+			return Frame{}, err
+		}
+		header := make([]byte, binaryHeaderSize, binaryHeaderSize+len(data))
+		header[0] = binaryPacket.BinaryType()
+		binary.BigEndian.PutUint32(header[1:], uint32(s.seq))
+		frame = Frame{append(header, data...), true}
+	} else {
+		packet := s.packet
+		if hasImages {
+			var err error
+			if packet, err = imagePacket.WithFormat(encoding.Format); err != nil {
+				return Frame{}, err
+			}
+		}
+		data, err := serializePacket(packet, s.seq)
+		if err != nil {
+			return Frame{}, err
+		}
+		frame = Frame{data, false}
+	}
+	s.frames[encoding] = frame
+	return frame, nil
 }
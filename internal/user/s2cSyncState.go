@@ -0,0 +1,18 @@
+package user
+
+const packet_type_sync_state = "sync_state"
+
+// The first packet sent to a connection. Clients keep the epoch, token and
+// latest sequence number to resume the connection if it's lost
+type syncStatePacket struct {
+	Epoch string `json:"epoch"`
+	Token string `json:"token"`
+	Seq   Seq    `json:"seq"`
+	// Whether the room's full state follows. If not, the connection was
+	// resumed and is only sent the broadcasts it missed
+	Full bool `json:"full"`
+}
+
+func (*syncStatePacket) PacketType() string {
+	return packet_type_sync_state
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Signs sessions so they can be stored in cookies without clients being able
+// to choose someone else's session
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{key}
+}
+
+// Cookie value for a session: the session and its HMAC separated by a dot
+func (s *Signer) Sign(session Session) string {
+	return string(session) + "." + base64.RawURLEncoding.EncodeToString(s.mac(session))
+}
+
+// Returns the session of a signed cookie value, or false if the value was
+// tampered with or signed with a different key
+func (s *Signer) Verify(value string) (Session, bool) {
+	session, signature, ok := strings.Cut(value, ".")
+	if !ok || session == "" {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(Session(session))) {
+		return "", false
+	}
+	return Session(session), true
+}
+
+func (s *Signer) mac(session Session) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(session))
+	return h.Sum(nil)
+}
+
+// Reads a signing key from a file, generating one if it doesn't exist yet so
+// sessions stay valid when the server restarts
+func LoadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < 16 {
+			return nil, errors.New("session key in " + path + " is too short")
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0600)
+}
@@ -0,0 +1,36 @@
+package user
+
+// Serializable state of a manager. Connections are not included since they
+// can't outlive the server
+type Snapshot struct {
+	Sessions   map[Session]Id `json:"sessions"`
+	NextUserId Id             `json:"next_user_id"`
+	Names      map[Id]string  `json:"names"`
+}
+
+func (users *Manager) Snapshot() Snapshot {
+	snapshot := Snapshot{map[Session]Id{}, users.nextUserId, map[Id]string{}}
+	for session, id := range users.sessions {
+		snapshot.Sessions[session] = id
+	}
+	for id, name := range users.names {
+		snapshot.Names[id] = name
+	}
+	return snapshot
+}
+
+func RestoreManager(snapshot Snapshot) *Manager {
+	users := NewManager()
+	users.nextUserId = snapshot.NextUserId
+	for session, id := range snapshot.Sessions {
+		users.sessions[session] = id
+		// Make sure new users never reuse the id of a restored one
+		if id > users.nextUserId {
+			users.nextUserId = id
+		}
+	}
+	for id, name := range snapshot.Names {
+		users.names[id] = name
+	}
+	return users
+}
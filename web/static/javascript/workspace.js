@@ -28,7 +28,7 @@ const Usernames = {
                 'name': name,
             },
         };
-        Socket.send(JSON.stringify(packet));
+        Requests.send(packet);
     },
 
     getName: function (user) {
@@ -88,8 +88,60 @@ const OnlineUsers = {
 }
 Usernames.addNameChangeCallback(OnlineUsers.updateOnlineUserDisplay.bind(OnlineUsers));
 
-const CANVAS_WIDTH = 1920;
-const CANVAS_HEIGHT = 1080;
+// Size of the room's canvas. Set by server once connected
+var CANVAS_WIDTH = 1920;
+var CANVAS_HEIGHT = 1080;
+
+const RoomInfo = {
+    name: "",
+    owner: 0,
+
+    set: function (info) {
+        this.name = info.name;
+        this.owner = info.owner;
+        if (info.width !== CANVAS_WIDTH || info.height !== CANVAS_HEIGHT) {
+            this.resizeCanvases(info.width, info.height);
+        }
+        this.updateControls();
+    },
+
+    // Crops or extends the contents of every canvas, keeping them anchored to
+    // the top left corner
+    resizeCanvases: function (width, height) {
+        CANVAS_WIDTH = width;
+        CANVAS_HEIGHT = height;
+        document.documentElement.style.setProperty("--canvas-aspect-ratio", `${width}/${height}`);
+
+        HUD.canvas.width = width;
+        HUD.canvas.height = height;
+        Layers.layers.forEach(layer => layer.resize(width, height));
+
+        document.getElementById("text_x").max = width;
+        document.getElementById("text_y").max = height;
+    },
+
+    updateControls: function () {
+        let controls = document.getElementById("room_owner_controls");
+        if (this.owner === LocalUserId) {
+            controls.style.display = "block";
+            document.getElementById("room_width").value = CANVAS_WIDTH;
+            document.getElementById("room_height").value = CANVAS_HEIGHT;
+        } else {
+            controls.style.removeProperty("display");
+        }
+    },
+
+    requestResize: function () {
+        let packet = {
+            'type': PACKET_RESIZE_ROOM,
+            'data': {
+                'width': Math.floor(document.getElementById("room_width").value),
+                'height': Math.floor(document.getElementById("room_height").value),
+            },
+        };
+        Requests.send(packet);
+    },
+};
 
 // A layer that can be drawn on
 class PaintLayer {
@@ -125,39 +177,68 @@ class PaintLayer {
         }
     }
 
-    drawLine(x1, y1, x2, y2) {
+    // Blends a canvas containing just the change being made onto the layer.
+    // The same change is sent to the server so that it can blend it the same
+    // way
+    drawPatch(patch, x, y, compositeOperation) {
         // Clear redo stack when making a new change
         this._redoStack = [];
 
         let ctx = this.canvas.getContext("2d");
-        ctx.beginPath();
-        ctx.moveTo(x1, y1);
-        ctx.lineTo(x2, y2);
-        ctx.stroke();
-    }
+        ctx.globalCompositeOperation = compositeOperation;
+        ctx.drawImage(patch, x, y);
+        ctx.globalCompositeOperation = "source-over";
 
-    sendRectDraw(minX, minY, maxX, maxY) {
-        // Make sure coords are within bounds
-        minX = Math.max(Math.floor(minX), 0);
-        minY = Math.max(Math.floor(minY), 0);
-        maxX = Math.min(Math.ceil(maxX), this.canvas.width - 1);
-        maxY = Math.min(Math.ceil(maxY), this.canvas.height - 1);
+        let imgData = patch.getContext("2d").getImageData(0, 0, patch.width, patch.height);
+        PaintLayer.sendDrawPacket(this.id, imgData, x, y, compositeOperation);
+    }
 
-        let width = maxX - minX + 1;
-        let height = maxY - minY + 1;
-        let imgData = this.canvas.getContext("2d").getImageData(minX, minY, width, height);
-        PaintLayer.sendDrawPacket(this.id, imgData, minX, minY);
+    // Blends image data received from the server onto the layer. Image data
+    // without a composite operation replaces what was on the layer
+    blendImageData(imgData, x, y, compositeOperation) {
+        let ctx = this.canvas.getContext("2d");
+        if (compositeOperation === undefined || compositeOperation === "copy") {
+            ctx.putImageData(imgData, x, y);
+            return;
+        }
+        let patch = document.createElement("canvas");
+        patch.width = imgData.width;
+        patch.height = imgData.height;
+        patch.getContext("2d").putImageData(imgData, 0, 0);
+        ctx.globalCompositeOperation = compositeOperation;
+        ctx.drawImage(patch, x, y);
+        ctx.globalCompositeOperation = "source-over";
     }
 
-    static sendDrawPacket(id, imgData, x, y) {
-        return Socket.send(JSON.stringify({
+    /** @param {string} [compositeOperation] Replaces pixels if not set */
+    static sendDrawPacket(id, imgData, x, y, compositeOperation) {
+        if (Socket.protocol === BINARY_SUBPROTOCOL) {
+            let requestId = Requests.newId(id);
+            return Requests.transmit(encodeBinaryPacket(BINARY_PAINT_LAYER_DRAW, requestId, id, [{ x: x, y: y, image: imgData }], compositeOperation));
+        }
+        return Requests.send({
             "type": PACKET_PAINT_LAYER_DRAW,
             "data": {
                 "pos": { "x": x, "y": y },
                 "image": encodeImageData(imgData),
                 "layer": id,
+                "mode": compositeOperation,
             },
-        }));
+        }, id);
+    }
+
+    resize(width, height) {
+        let copy = document.createElement("canvas");
+        copy.width = this.canvas.width;
+        copy.height = this.canvas.height;
+        copy.getContext("2d").drawImage(this.canvas, 0, 0);
+
+        // Changing the size of a canvas clears it
+        this.canvas.width = width;
+        this.canvas.height = height;
+        this.canvas.getContext("2d").drawImage(copy, 0, 0);
+        // Edits may no longer be within the canvas
+        this.clearEditHistory();
     }
 
     static MAX_HISTORY = 15; // The maximum number of saved undo/redo edits
@@ -338,6 +419,12 @@ class TextLayer {
         this.sendSetInfoPacket(this.textInfo);
     }
 
+    resize(width, height) {
+        this.canvas.width = width;
+        this.canvas.height = height;
+        if (this.textInfo !== null) this.setTextInfo(this.textInfo);
+    }
+
     clearCanvas() {
         if (this.textInfo === null) return;
         let ctx = this.canvas.getContext("2d");
@@ -361,7 +448,7 @@ class TextLayer {
                 layer: this.id,
             },
         };
-        Socket.send(JSON.stringify(packet));
+        Requests.send(packet, this.id);
     }
 
     static updateActive() {
@@ -504,6 +591,10 @@ const Layers = {
     },
 
     // Can be called locally or prompted by server
+    clear: function () {
+        Object.values(this.idToLayer).forEach(layer => this.deleteLayer(layer.id));
+    },
+
     deleteLayer: function (id) {
         let layer = this.idToLayer[id];
         if (layer != undefined) {
@@ -524,7 +615,7 @@ const Layers = {
                 'type': PACKET_C2S_DELETE_LAYER,
                 'data': this.activeLayer.id,
             };
-            Socket.send(JSON.stringify(packet));
+            Requests.send(packet);
         }
     },
 
@@ -537,7 +628,7 @@ const Layers = {
                     move_by: moveBy,
                 },
             };
-            Socket.send(JSON.stringify(packet));
+            Requests.send(packet);
         }
     },
 
@@ -570,7 +661,7 @@ const Layers = {
                 'new_name': name,
             },
         };
-        Socket.send(JSON.stringify(packet));
+        Requests.send(packet, this.activeLayer.id);
 
     },
 
@@ -583,7 +674,7 @@ const Layers = {
                     new_owner: 0,
                 },
             };
-            Socket.send(JSON.stringify(packet));
+            Requests.send(packet);
         }
     },
 
@@ -596,7 +687,7 @@ const Layers = {
                     new_owner: LocalUserId,
                 },
             };
-            Socket.send(JSON.stringify(packet));
+            Requests.send(packet);
         }
     },
 
@@ -613,7 +704,7 @@ const Layers = {
             'type': PACKET_C2S_CREATE_LAYER,
             'data': type,
         };
-        Socket.send(JSON.stringify(packet));
+        Requests.send(packet);
     },
 
     /** @param {function():void} callback */
@@ -658,17 +749,176 @@ const HUD = {
     }
 };
 
+// Image formats described in the README
+const FORMAT_RGBA = "rgba";
+const FORMAT_DEFLATE = "deflate";
+const FORMAT_RLE = "rle";
+const FORMAT_PNG = "png";
+// Formats this browser can decode, which the server picks from
+const SUPPORTED_FORMATS = [FORMAT_PNG, FORMAT_RLE];
+if (typeof DecompressionStream !== "undefined") SUPPORTED_FORMATS.push(FORMAT_DEFLATE);
+
+// Close code of connections the server closed because they were idle
+const CLOSE_IDLE = 4000;
+// Sent when an administrator removes the connection or closes the room
+const CLOSE_REMOVED = 4001;
+// Sent when the connection fell too far behind the room to keep up
+const CLOSE_TOO_SLOW = 4002;
+
+// Servers that accept this subprotocol send pixel data as binary messages. The
+// format is described in the README
+const BINARY_SUBPROTOCOL = "whiteboard-binary-v1";
+const BINARY_PAINT_LAYER_DRAW = 1;
+const BINARY_PAINT_LAYER_SET = 2;
+const BINARY_FLAG_CLEAR = 1;
+// Image formats are sent as their index
+const BINARY_FORMATS = [FORMAT_RGBA, FORMAT_DEFLATE, FORMAT_RLE, FORMAT_PNG];
+// Composite operations are sent as their index
+const BINARY_BLEND_MODES = ["copy", "source-over", "multiply", "screen", "destination-out"];
+
 /** @type {WebSocket} */
 var Socket;
-{
-    let path = window.location.href;
-    if (path.charAt(path.length - 1) != '/') path = path + '/';
-    path = path + "ws";
-    let url = new URL(path);
-    url.protocol = url.protocol.replace('http', 'ws');
-    Socket = new WebSocket(url.href);
-}
-window.onclose = (_) => Socket.close();
+
+// Tracks requests sent to the server, so layers changed by rejected requests
+// can be resynced
+const Requests = {
+    _nextId: 1,
+    // Maps ids of unanswered requests to the layer they change, and whether
+    // they are a resync of that layer
+    /** @type {Map<number, {layer: number|undefined, resync: boolean}>} */
+    _pending: new Map(),
+    // Layers being resynced, so each is only resynced once at a time
+    _resyncing: new Set(),
+
+    /** @param {number} [layerId] Layer changed by the request */
+    newId: function (layerId, resync = false) {
+        let id = this._nextId++;
+        this._pending.set(id, { layer: layerId, resync: resync });
+        return id;
+    },
+
+    /** @param {number} [layerId] Layer changed by the request */
+    send: function (packet, layerId, resync = false) {
+        packet.request_id = this.newId(layerId, resync);
+        this.transmit(JSON.stringify(packet));
+    },
+
+    // Requests made while disconnected are dropped, and the layers they
+    // changed are resynced once reconnected
+    transmit: function (data) {
+        if (Socket.readyState === WebSocket.OPEN) Socket.send(data);
+    },
+
+    // Called once reconnected. Requests sent before the connection was lost
+    // will never be answered, so the layers they changed are resynced unless
+    // the whole room is being sent again
+    reconnected: function (full) {
+        let layers = new Set();
+        this._pending.forEach(request => {
+            if (request.layer !== undefined) layers.add(request.layer);
+        });
+        this._pending.clear();
+        this._resyncing.clear();
+        if (full) return;
+        layers.forEach(layer => {
+            this._resyncing.add(layer);
+            this.send({ "type": PACKET_RESYNC_LAYER, "data": { "layer": layer } }, layer, true);
+        });
+    },
+
+    _finish: function (requestId) {
+        let request = this._pending.get(requestId);
+        this._pending.delete(requestId);
+        if (request !== undefined && request.resync) this._resyncing.delete(request.layer);
+        return request;
+    },
+
+    ack: function (data) {
+        this._finish(data.request_id);
+    },
+
+    error: function (data) {
+        console.log(`error: ${data.packet_type} rejected (${data.code}): ${data.message}`);
+        let request = this._finish(data.request_id);
+        if (request === undefined || request.resync || request.layer === undefined) return;
+        if (this._resyncing.has(request.layer)) return;
+        this._resyncing.add(request.layer);
+        this.send({ "type": PACKET_RESYNC_LAYER, "data": { "layer": request.layer } }, request.layer, true);
+    },
+};
+
+// Reconnects when the connection is lost, resuming from the last broadcast
+// received so only missed broadcasts are sent again
+const SyncState = {
+    // Set from sync_state packets
+    epoch: null,
+    token: null,
+    // Sequence number of the last broadcast received
+    lastSeq: 0,
+
+    _retryDelay: 500,
+    _maxRetryDelay: 10000,
+
+    connect: function () {
+        let path = window.location.href;
+        if (path.charAt(path.length - 1) != '/') path = path + '/';
+        path = path + "ws";
+        let url = new URL(path);
+        url.protocol = url.protocol.replace('http', 'ws');
+        url.searchParams.set("formats", SUPPORTED_FORMATS.join(","));
+        if (this.token !== null) {
+            url.searchParams.set("resume", this.token);
+            url.searchParams.set("epoch", this.epoch);
+            url.searchParams.set("seq", this.lastSeq);
+        }
+        Socket = new WebSocket(url.href, [BINARY_SUBPROTOCOL]);
+        Socket.binaryType = "arraybuffer";
+        Socket.onmessage = onSocketMessage;
+        Socket.onclose = event => {
+            if (event.code === CLOSE_IDLE) {
+                console.log("closed while idle, reconnecting once used again");
+                this._reconnectWhenUsed();
+                return;
+            }
+            if (event.code === CLOSE_TOO_SLOW) {
+                console.warn(`disconnected: ${event.reason}, reconnecting once used again`);
+                this._reconnectWhenUsed();
+                return;
+            }
+            if (event.code === CLOSE_REMOVED) {
+                alert(`Disconnected: ${event.reason}`);
+                return;
+            }
+            console.log(`connection lost, reconnecting in ${this._retryDelay}ms`);
+            setTimeout(this.connect.bind(this), this._retryDelay);
+            this._retryDelay = Math.min(this._retryDelay * 2, this._maxRetryDelay);
+        };
+    },
+
+    _reconnectWhenUsed: function () {
+        const events = ["pointerdown", "keydown", "focus"];
+        const reconnect = () => {
+            events.forEach(e => window.removeEventListener(e, reconnect));
+            this.connect();
+        };
+        events.forEach(e => window.addEventListener(e, reconnect));
+    },
+
+    set: function (data) {
+        this.epoch = data.epoch;
+        this.token = data.token;
+        this.lastSeq = data.seq;
+        this._retryDelay = 500;
+        // The room's whole state follows, so start from nothing
+        if (data.full) Layers.clear();
+        Requests.reconnected(data.full);
+    },
+
+    /** @param {number} [seq] Only set for broadcasts */
+    received: function (seq) {
+        if (seq) this.lastSeq = Math.max(this.lastSeq, seq);
+    },
+};
 
 /** @param {Uint8ClampedArray} array */
 const uint8ToBase64 = function (array) {
@@ -707,17 +957,186 @@ const encodeImageData = function (image) {
 }
 
 /**
- * @param {Object} img
+ * Images from binary packets are already decoded
+ * @param {Object|ImageData} img
  * @param {string} img.data
  * @param {number} img.width
  * @param {number} img.height
+ * @param {string} [img.format] Defaults to rgba
  */
-const decodeImageData = function (img) {
-    return new ImageData(
-        base64ToUint8(img.data),
-        img.width,
-        img.height
-    );
+const decodeImageData = async function (img) {
+    if (img instanceof ImageData) return img;
+    return decodePixels(base64ToUint8(img.data), img.format, img.width, img.height);
+}
+
+/**
+ * @param {Uint8Array} data
+ * @param {string} [format] Defaults to rgba
+ */
+const decodePixels = async function (data, format, width, height) {
+    let pixels;
+    switch (format) {
+        case undefined:
+        case FORMAT_RGBA:
+            pixels = data;
+            break;
+        case FORMAT_DEFLATE:
+            pixels = await inflate(data);
+            break;
+        case FORMAT_RLE:
+            pixels = decodeRLE(data, width * height * 4);
+            break;
+        case FORMAT_PNG:
+            return decodePNG(data, width, height);
+        default:
+            throw (`error: unknown image format "${format}"`);
+    }
+    return new ImageData(new Uint8ClampedArray(pixels.buffer, pixels.byteOffset, pixels.length), width, height);
+}
+
+/** @param {Uint8Array} data */
+const decodePNG = async function (data, width, height) {
+    let bitmap = await createImageBitmap(new Blob([data], { type: "image/png" }), {
+        premultiplyAlpha: "none",
+        colorSpaceConversion: "none",
+    });
+    let canvas = document.createElement("canvas");
+    canvas.width = width;
+    canvas.height = height;
+    let ctx = canvas.getContext("2d");
+    ctx.drawImage(bitmap, 0, 0);
+    bitmap.close();
+    return ctx.getImageData(0, 0, width, height);
+}
+
+/**
+ * Decodes pixels encoded with QOI operations, as described in the README
+ * @param {Uint8Array} data
+ * @param {number} size Length of the decoded pixels in bytes
+ */
+const decodeRLE = function (data, size) {
+    let pixels = new Uint8Array(size);
+    let index = new Uint8Array(64 * 4);
+    let r = 0, g = 0, b = 0, a = 255;
+    let p = 0;
+    for (let i = 0; i < data.length && p < size;) {
+        let op = data[i++];
+        let run = 1;
+        if (op === 0xfe) {
+            r = data[i++]; g = data[i++]; b = data[i++];
+        } else if (op === 0xff) {
+            r = data[i++]; g = data[i++]; b = data[i++]; a = data[i++];
+        } else if ((op & 0xc0) === 0x00) {
+            r = index[op * 4]; g = index[op * 4 + 1]; b = index[op * 4 + 2]; a = index[op * 4 + 3];
+        } else if ((op & 0xc0) === 0x40) {
+            r = (r + ((op >> 4) & 3) - 2) & 0xff;
+            g = (g + ((op >> 2) & 3) - 2) & 0xff;
+            b = (b + (op & 3) - 2) & 0xff;
+        } else if ((op & 0xc0) === 0x80) {
+            let dg = (op & 0x3f) - 32;
+            let next = data[i++];
+            r = (r + dg - 8 + ((next >> 4) & 0x0f)) & 0xff;
+            g = (g + dg) & 0xff;
+            b = (b + dg - 8 + (next & 0x0f)) & 0xff;
+        } else {
+            run = (op & 0x3f) + 1;
+        }
+        let h = ((r * 3 + g * 5 + b * 7 + a * 11) % 64) * 4;
+        index[h] = r; index[h + 1] = g; index[h + 2] = b; index[h + 3] = a;
+        for (; run > 0 && p < size; run--) {
+            pixels[p++] = r; pixels[p++] = g; pixels[p++] = b; pixels[p++] = a;
+        }
+    }
+    return pixels;
+}
+
+/**
+ * Encodes rectangles of uncompressed pixels into a binary packet
+ * @param {{x: number, y: number, image: ImageData}[]} rects
+ * @param {string} [compositeOperation] Replaces pixels if not set
+ */
+const encodeBinaryPacket = function (type, requestId, layer, rects, compositeOperation, flags = 0) {
+    const headerSize = 16;
+    const rectHeaderSize = 20;
+    let size = headerSize;
+    rects.forEach(r => size += rectHeaderSize + r.image.data.length);
+
+    let buffer = new ArrayBuffer(size);
+    let view = new DataView(buffer);
+    let mode = BINARY_BLEND_MODES.indexOf(compositeOperation);
+    view.setUint8(0, type);
+    view.setUint32(1, requestId);
+    view.setUint8(5, mode < 0 ? 0 : mode);
+    view.setUint8(6, BINARY_FORMATS.indexOf(FORMAT_RGBA));
+    view.setUint8(7, flags);
+    view.setUint32(8, layer);
+    view.setUint32(12, rects.length);
+    let offset = headerSize;
+    rects.forEach(r => {
+        view.setInt32(offset, r.x);
+        view.setInt32(offset + 4, r.y);
+        view.setUint32(offset + 8, r.image.width);
+        view.setUint32(offset + 12, r.image.height);
+        view.setUint32(offset + 16, r.image.data.length);
+        new Uint8Array(buffer, offset + rectHeaderSize).set(r.image.data);
+        offset += rectHeaderSize + r.image.data.length;
+    });
+    return buffer;
+}
+
+/** @param {Uint8Array} data */
+const inflate = async function (data) {
+    let stream = new Blob([data]).stream().pipeThrough(new DecompressionStream("deflate-raw"));
+    return new Uint8Array(await new Response(stream).arrayBuffer());
+}
+
+/**
+ * Decodes a binary packet into the same form as its JSON equivalent, except
+ * that images are ImageData
+ * @param {ArrayBuffer} buffer
+ */
+const decodeBinaryPacket = async function (buffer) {
+    const headerSize = 16;
+    const rectHeaderSize = 20;
+    let view = new DataView(buffer);
+    // Packets from the server have their sequence number in place of a
+    // request id
+    let type = view.getUint8(0);
+    let seq = view.getUint32(1);
+    let mode = BINARY_BLEND_MODES[view.getUint8(5)];
+    let format = BINARY_FORMATS[view.getUint8(6)];
+    let flags = view.getUint8(7);
+    let layer = view.getUint32(8);
+    let count = view.getUint32(12);
+
+    let rects = [];
+    let offset = headerSize;
+    for (let i = 0; i < count; i++) {
+        let x = view.getInt32(offset);
+        let y = view.getInt32(offset + 4);
+        let width = view.getUint32(offset + 8);
+        let height = view.getUint32(offset + 12);
+        let length = view.getUint32(offset + 16);
+        let image = await decodePixels(new Uint8Array(buffer, offset + rectHeaderSize, length), format, width, height);
+        offset += rectHeaderSize + length;
+        rects.push({ pos: { x: x, y: y }, image: image });
+    }
+
+    switch (type) {
+        case BINARY_PAINT_LAYER_DRAW:
+            return {
+                type: PACKET_PAINT_LAYER_DRAW,
+                seq: seq,
+                data: { pos: rects[0].pos, image: rects[0].image, layer: layer, mode: mode },
+            };
+        case BINARY_PAINT_LAYER_SET:
+            if (flags & BINARY_FLAG_CLEAR) {
+                return { type: PACKET_PAINT_LAYER_SET, seq: seq, data: { tiles: rects, layer: layer } };
+            }
+            return { type: PACKET_PAINT_LAYER_SET, seq: seq, data: { image: rects[0].image, layer: layer } };
+        default:
+            throw (`error: unknown binary packet type ${type}`);
+    }
 }
 
 // Maps layer type names to their class
@@ -742,11 +1161,31 @@ const PACKET_S2C_LAYER_SET_HEIGHT = "s2c_set_layer_height";
 const PACKET_PAINT_LAYER_SET = "paint_layer_set";
 const PACKET_PAINT_LAYER_DRAW = "paint_layer_draw";
 const PACKET_TEXT_LAYER_SET = "text_layer_set";
+const PACKET_ROOM_INFO = "room_info";
+const PACKET_RESIZE_ROOM = "resize_room";
+const PACKET_ACK = "ack";
+const PACKET_ERROR = "error";
+const PACKET_RESYNC_LAYER = "resync_layer";
+const PACKET_SYNC_STATE = "sync_state";
+const PACKET_NOTICE = "notice";
 
 // Handle received packets
 const S2CPacketHandlers = {
+    [PACKET_SYNC_STATE]: SyncState.set.bind(SyncState),
+
     [PACKET_SET_USER_ID]: data => LocalUserId = data,
 
+    [PACKET_ROOM_INFO]: RoomInfo.set.bind(RoomInfo),
+
+    [PACKET_ACK]: Requests.ack.bind(Requests),
+
+    [PACKET_ERROR]: Requests.error.bind(Requests),
+
+    [PACKET_NOTICE]: data => {
+        if (data.code === "system") alert(data.message);
+        else console.warn(`notice from server (${data.code}): ${data.message}`);
+    },
+
     [PACKET_MAP_USERNAMES]: Usernames.setNames.bind(Usernames),
 
     [PACKET_SET_USERNAME]: data => Usernames.setName(data.id, data.name),
@@ -772,20 +1211,28 @@ const S2CPacketHandlers = {
 
     [PACKET_S2C_LAYER_SET_HEIGHT]: data => Layers.setHeight(data.layer, data.height),
 
-    [PACKET_PAINT_LAYER_SET]: data => {
+    [PACKET_PAINT_LAYER_SET]: async data => {
         let layer = Layers.getChecked(data.layer, PaintLayer);
+        // Decode everything before changing the layer so it's never half set
+        let image = data.image ? await decodeImageData(data.image) : null;
+        let tiles = data.tiles ? await Promise.all(data.tiles.map(tile => decodeImageData(tile.image))) : null;
         layer.clearEditHistory(); // Edit history is invalid if last changed by server
-        let imageData = decodeImageData(data.image);
         let ctx = layer.canvas.getContext("2d");
-        ctx.putImageData(imageData, 0, 0);
+        if (image) {
+            ctx.putImageData(image, 0, 0);
+        }
+        // Only tiles that have been drawn on are sent
+        if (tiles) {
+            ctx.clearRect(0, 0, layer.canvas.width, layer.canvas.height);
+            data.tiles.forEach((tile, i) => ctx.putImageData(tiles[i], tile.pos.x, tile.pos.y));
+        }
     },
 
-    [PACKET_PAINT_LAYER_DRAW]: data => {
+    [PACKET_PAINT_LAYER_DRAW]: async data => {
         let layer = Layers.getChecked(data.layer, PaintLayer);
+        let imageData = await decodeImageData(data.image);
         layer.clearEditHistory(); // Edit history is invalid if last changed by server
-        let imageData = decodeImageData(data.image);
-        let ctx = layer.canvas.getContext("2d");
-        ctx.putImageData(imageData, data.pos.x, data.pos.y);
+        layer.blendImageData(imageData, data.pos.x, data.pos.y, data.mode);
     },
 
     [PACKET_TEXT_LAYER_SET]: data => {
@@ -793,18 +1240,28 @@ const S2CPacketHandlers = {
     },
 }
 
+// Decoding images may be asynchronous, so messages are handled
+// through a queue to keep them in order
+let incomingMessages = Promise.resolve();
+
 // Reads and handles incoming messages from the server
-Socket.onmessage = function (e) {
-    let msg = JSON.parse(e.data);
-    let t = msg.type;
-    let h = S2CPacketHandlers[t];
-    if (!!h) {
-        h(msg.data);
-    } else {
-        console.log("error: unknown packet type `" + t + "`");
-    }
+const onSocketMessage = function (e) {
+    incomingMessages = incomingMessages.then(async () => {
+        let msg = typeof e.data === "string" ? JSON.parse(e.data) : await decodeBinaryPacket(e.data);
+        SyncState.received(msg.seq);
+        let t = msg.type;
+        let h = S2CPacketHandlers[t];
+        if (!!h) {
+            await h(msg.data);
+        } else {
+            console.log("error: unknown packet type `" + t + "`");
+        }
+    }).catch(err => console.log(err));
 }
 
+SyncState.connect();
+window.onclose = (_) => Socket.close();
+
 /**
  * Used to find a rectangle containing all changed pixels in a paint
  * @property {HTMLCanvasElement} layer
@@ -900,15 +1357,6 @@ class Brush {
         // Start a new edit if one isn't already in progress
         Layers.activeLayer.startEdit();
 
-        let ctx = Layers.activeLayer.canvas.getContext("2d");
-        // Set canvas settings before draw
-        ctx.globalCompositeOperation = this.compositeOperation;
-        ctx.strokeStyle = Brush.COLOR;
-        ctx.lineWidth = Brush.SIZE;
-        ctx.lineCap = "round";
-
-        Layers.activeLayer.drawLine(x1, y1, x2, y2);
-
         // Give the rectangle enough padding to contain the
         // whole edit, while not being excessively big at the same time
         let minX = Math.min(x1, x2) - (Brush.SIZE / 1.8) - 2;
@@ -916,7 +1364,29 @@ class Brush {
         let maxX = Math.max(x1, x2) + (Brush.SIZE / 1.8) + 2;
         let maxY = Math.max(y1, y2) + (Brush.SIZE / 1.8) + 2;
         Layers.activeLayer.updateEditBounds(minX, minY, maxX, maxY);
-        Layers.activeLayer.sendRectDraw(minX, minY, maxX, maxY);
+
+        // Make sure coords are within bounds
+        minX = Math.max(Math.floor(minX), 0);
+        minY = Math.max(Math.floor(minY), 0);
+        maxX = Math.min(Math.ceil(maxX), Layers.activeLayer.canvas.width - 1);
+        maxY = Math.min(Math.ceil(maxY), Layers.activeLayer.canvas.height - 1);
+        if (maxX < minX || maxY < minY) return;
+
+        // The line is drawn by itself so that it can be blended onto the layer
+        // using the brush's composite operation
+        let patch = document.createElement("canvas");
+        patch.width = maxX - minX + 1;
+        patch.height = maxY - minY + 1;
+        let ctx = patch.getContext("2d");
+        ctx.strokeStyle = Brush.COLOR;
+        ctx.lineWidth = Brush.SIZE;
+        ctx.lineCap = "round";
+        ctx.beginPath();
+        ctx.moveTo(x1 - minX, y1 - minY);
+        ctx.lineTo(x2 - minX, y2 - minY);
+        ctx.stroke();
+
+        Layers.activeLayer.drawPatch(patch, minX, minY, this.compositeOperation);
     }
 
     onSelect() {
@@ -0,0 +1,21 @@
+// Package web holds the web client's templates and static files. They're
+// embedded in the server so it can run from any directory
+package web
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+//go:embed templates static
+var embedded embed.FS
+
+// Returns a directory on disk laid out like this one, for changing the client
+// without rebuilding the server, or the embedded files if dir is empty
+func Files(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	return embedded
+}